@@ -1,18 +1,184 @@
-// +build windows
-
 package main
 
 import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
 	"os"
+	"strings"
 
+	"github.com/kardianos/service"
 	"github.com/tktip/flyvo-rpc-client/internal/log"
+	"github.com/tktip/flyvo-rpc-client/internal/secret"
 	"github.com/tktip/flyvo-rpc-client/internal/tipservice"
+	"github.com/tktip/flyvo-rpc-client/internal/version"
 )
 
+const usage = `Usage: flyvo-rpc-client [command] [--config path] [--<setting>=value ...]
+
+Commands:
+  run              run in the foreground, or as the service when started by the
+                   service manager (default)
+  install          install as a Windows service or systemd unit, running with --config
+  uninstall        remove the installed service
+  start            start the installed service
+  stop             stop the installed service
+  status           show whether the service is installed and running
+  validate-config  check the config, listing every problem
+  print-config     show the effective config, with secrets masked
+  encrypt-secret   encrypt a secret read from stdin with DPAPI (Windows), for
+                   use as a dpapi:: value in the config
+  version          show the version
+
+The config is a path, or a cfger source such as env::CONFIG. Without --config,
+the CONFIG environment variable is used. configFile=path is accepted in place of
+a command, as used by services installed with sc.exe.
+
+Any setting can be overridden by an environment variable named FLYVO_RPC_ and
+its path, e.g. FLYVO_RPC_API_RPC_SERVERADDRESS=tip:50051, and by a flag named by
+its path, e.g. --api.rpc.serverAddress=tip:50051. Flags take precedence over
+environment variables, which take precedence over the config file. Lists are
+comma separated, and maps are comma separated key=value pairs.
+`
+
 func main() {
-	s := tipservice.New(os.Args)
-	err := s.Run()
+	os.Exit(runCommand(os.Args[1:]))
+}
+
+func runCommand(args []string) int {
+	command := "run"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") && !strings.HasPrefix(args[0], "configFile=") {
+		command, args = args[0], args[1:]
+	}
+
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	config := flags.String("config", os.Getenv("CONFIG"), "config file, or a cfger source")
+	tipservice.AddFlags(flags)
+	if len(args) > 0 && strings.HasPrefix(args[0], "configFile=") {
+		*config, args = args[0], args[1:]
+	}
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if flags.NArg() > 0 {
+		*config = flags.Arg(0)
+	}
+
+	source := ""
+	if *config != "" {
+		source = tipservice.SourceFromArg(*config)
+	}
+
+	switch command {
+	case "version":
+		fmt.Println(version.VERSION)
+		return 0
+	case "validate-config":
+		return tipservice.ValidateCommand(os.Stdout, source)
+	case "print-config":
+		return printConfig(source)
+	case "encrypt-secret":
+		return encryptSecret()
+	case "run", "install":
+	case "uninstall", "start", "stop", "status":
+		source = ""
+	case "help":
+		flags.Usage()
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command '%s'\n\n", command)
+		flags.Usage()
+		return 2
+	}
+
+	if command == "install" {
+		if secrets := tipservice.SecretFlags(); len(secrets) > 0 {
+			fmt.Fprintf(os.Stderr, "Secrets can't be given as flags to install, as the service would store "+
+				"them in plaintext: %s\nGive them as env::, file:: or dpapi:: references instead\n",
+				strings.Join(secrets, ", "))
+			return 2
+		}
+		if tipservice.ValidateCommand(os.Stdout, source) != 0 {
+			return 1
+		}
+	}
+
+	s, err := tipservice.New(source)
 	if err != nil {
 		log.Logger.Error(err)
+		return 1
+	}
+
+	switch command {
+	case "run":
+		err = s.Run()
+	case "status":
+		err = printStatus(s)
+	default:
+		err = service.Control(s, command)
+		if err == nil {
+			fmt.Printf("Service %s: %s done\n", s, command)
+		}
+	}
+	if err != nil {
+		log.Logger.Error(err)
+		return 1
+	}
+	return 0
+}
+
+func printConfig(source string) int {
+	conf, err := tipservice.Load(source)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	for _, line := range conf.Effective() {
+		fmt.Println(line)
+	}
+	return 0
+}
+
+func encryptSecret() int {
+	fmt.Fprintln(os.Stderr, "Enter the secret, followed by enter:")
+	value, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	value = strings.TrimRight(value, "\r\n")
+	if value == "" {
+		fmt.Fprintln(os.Stderr, "No secret given")
+		return 2
+	}
+	encrypted, err := secret.Protect(value)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println(encrypted.Value())
+	return 0
+}
+
+func printStatus(s service.Service) error {
+	status, err := s.Status()
+	if err == service.ErrNotInstalled {
+		fmt.Printf("Service %s is not installed\n", s)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not get the status of %s: %w", s, err)
+	}
+
+	switch status {
+	case service.StatusRunning:
+		fmt.Printf("Service %s is running\n", s)
+	case service.StatusStopped:
+		fmt.Printf("Service %s is stopped\n", s)
+	default:
+		fmt.Printf("Service %s is in an unknown state\n", s)
 	}
+	return nil
 }
@@ -3,19 +3,45 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
 	tipRPC "github.com/tktip/flyvo-api/pkg/rpc"
 	"github.com/tktip/flyvo-rpc-client/internal/log"
+	"github.com/tktip/flyvo-rpc-client/internal/outbox"
 	"github.com/tktip/flyvo-rpc-client/internal/rpc"
+	"github.com/tktip/flyvo-rpc-client/internal/tlsconfig"
+	"github.com/tktip/flyvo-rpc-client/internal/tracing"
+	"github.com/tktip/flyvo-rpc-client/internal/version"
+	"github.com/tktip/flyvo-rpc-client/pkg/healthcheck"
 )
 
+const defaultShutdownTimeout = 30 * time.Second
+
 type Server struct {
-	Port           string        `yaml:"port"`
-	RequestTimeout time.Duration `yaml:"timeout"`
-	RpcClient      *rpc.Client   `yaml:"rpc"`
+	Address         string             `yaml:"address"`
+	Port            string             `yaml:"port"`
+	TLS             tlsconfig.Files    `yaml:"tls"`
+	RequireCert     bool               `yaml:"requireClientCert"`
+	RequestTimeout  time.Duration      `yaml:"timeout"`
+	ShutdownTimeout time.Duration      `yaml:"shutdownTimeout"`
+	RpcClient       *rpc.Client        `yaml:"rpc"`
+	Auth            Auth               `yaml:"auth"`
+	Outbox          outbox.Config      `yaml:"outbox"`
+	Health          healthcheck.Config `yaml:"health"`
+	// RemoveParticipant enables /events/:id/participants/:vismaId, which
+	// sends a value format TIP has not agreed to yet
+	RemoveParticipant bool `yaml:"removeParticipant"`
+
+	queue   *outbox.Outbox
+	timeout atomic.Value
+	reload  func() error
 }
 type ActivityRequest struct {
 	Activity tipRPC.Event `json:"activity"`
@@ -41,8 +67,9 @@ func (s *Server) SendGenericRequest(c *gin.Context) {
 		c.String(http.StatusBadRequest, "no path provided in request body")
 		return
 	}
+	logger := requestLogger(c, logrus.Fields{"msgID": g.MsgID, "path": g.Path})
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	ctx, cancel := context.WithTimeout(tracing.Detach(c.Request.Context()), time.Second*10)
 	defer cancel()
 
 	resp, err := s.RpcClient.SendGeneric(ctx, tipRPC.Generic{
@@ -53,12 +80,12 @@ func (s *Server) SendGenericRequest(c *gin.Context) {
 	})
 
 	if err != nil {
-		log.Logger.Errorf("Error on generic rpc call: %s", err.Error())
+		logger.Errorf("Error on generic rpc call: %s", err.Error())
 		c.String(http.StatusInternalServerError, "Error on generic rpc call: "+err.Error())
 		return
 	}
 
-	log.Logger.Debugf("Received rpc response from server: %+v", resp)
+	logger.Debugf("Received rpc response from server: status[%d], body[%s]", resp.Status, resp.Body)
 	c.Writer.WriteHeader(int(resp.Status))
 	for h, v := range resp.Headers {
 		c.Header(h, v)
@@ -67,6 +94,15 @@ func (s *Server) SendGenericRequest(c *gin.Context) {
 	c.Writer.Write(resp.Body)
 }
 
+// tipStatus returns the http status of a response from TIP to a participant
+// removal, 502 if TIP did not set one
+func tipStatus(response *tipRPC.Generic) int {
+	if response.Status == 0 {
+		return http.StatusBadGateway
+	}
+	return int(response.Status)
+}
+
 // generic proxies create event request to TIP
 // @Summary proxies create event request to TIP
 // @Accept application/json
@@ -89,21 +125,33 @@ func (s *Server) PostEvent(c *gin.Context) {
 		return
 	}
 
+	logger := requestLogger(c, logrus.Fields{"vismaActivityId": actReq.Activity.VismaActivityId})
 	eventjson, _ := json.Marshal(actReq)
-	log.Logger.Debugf("Post event: %s", eventjson)
+	logger.Debugf("Post event: %s", eventjson)
 
-	ctx, cancel := context.WithTimeout(context.Background(), s.RequestTimeout)
+	queued := outbox.Entry{
+		Operation:  outbox.OpPublish,
+		ActivityID: actReq.Activity.VismaActivityId,
+		Event:      &actReq.Activity,
+	}
+	if s.queueEvent(c, queued, nil) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(tracing.Detach(c.Request.Context()), s.requestTimeout())
 	defer cancel()
 
 	response, err := s.RpcClient.PostEvent(ctx, &actReq.Activity)
 	if err != nil {
+		if s.queueEvent(c, queued, err) {
+			return
+		}
 		c.String(http.StatusInternalServerError, err.Error())
-		log.Logger.Errorf("Failed to post event: %s", err.Error())
+		logger.Errorf("Failed to post event: %s", err.Error())
 		return
 	}
 
-	respJson, _ := json.Marshal(response)
-	log.Logger.Debugf("POST Response: %s", respJson)
+	logger.Debugf("POST Response: status[%d], body[%s]", response.Status, response.Body)
 
 	c.Writer.WriteHeader(http.StatusOK)
 	c.Writer.Write(response.Body)
@@ -127,21 +175,33 @@ func (s *Server) PutEvent(c *gin.Context) {
 		return
 	}
 
+	logger := requestLogger(c, logrus.Fields{"vismaActivityId": actReq.Activity.VismaActivityId})
 	eventjson, _ := json.Marshal(actReq)
-	log.Logger.Debugf("Put event: %s", eventjson)
+	logger.Debugf("Put event: %s", eventjson)
 
-	ctx, cancel := context.WithTimeout(context.Background(), s.RequestTimeout)
+	queued := outbox.Entry{
+		Operation:  outbox.OpUpdate,
+		ActivityID: actReq.Activity.VismaActivityId,
+		Event:      &actReq.Activity,
+	}
+	if s.queueEvent(c, queued, nil) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(tracing.Detach(c.Request.Context()), s.requestTimeout())
 	defer cancel()
 
 	response, err := s.RpcClient.PutEvent(ctx, &actReq.Activity)
 	if err != nil {
+		if s.queueEvent(c, queued, err) {
+			return
+		}
 		c.String(http.StatusInternalServerError, "Failed to post event: "+err.Error())
-		log.Logger.Errorf("Failed to post event: %s", err.Error())
+		logger.Errorf("Failed to post event: %s", err.Error())
 		return
 	}
 
-	respJson, _ := json.Marshal(response)
-	log.Logger.Debugf("PUT Response: %s", respJson)
+	logger.Debugf("PUT Response: status[%d], body[%s]", response.Status, response.Body)
 
 	c.Writer.WriteHeader(http.StatusOK)
 	c.Writer.Write(response.Body)
@@ -164,68 +224,276 @@ func (s *Server) DeleteEvent(c *gin.Context) {
 		return
 	}
 
-	log.Logger.Debugf("Delete event: %s", id)
+	logger := requestLogger(c, logrus.Fields{"vismaActivityId": id})
+	logger.Debug("Delete event")
+	queued := outbox.Entry{Operation: outbox.OpDelete, ActivityID: id}
+	if s.queueEvent(c, queued, nil) {
+		return
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), s.RequestTimeout)
+	ctx, cancel := context.WithTimeout(tracing.Detach(c.Request.Context()), s.requestTimeout())
 	defer cancel()
 
 	response, err := s.RpcClient.DeleteEvent(ctx, id)
 	if err != nil {
+		if s.queueEvent(c, queued, err) {
+			return
+		}
 		c.String(http.StatusInternalServerError, "Failed to delete event: "+err.Error())
-		log.Logger.Errorf("Failed to post event: %s", err.Error())
+		logger.Errorf("Failed to post event: %s", err.Error())
 		return
 	}
 
-	respJson, _ := json.Marshal(response)
-	log.Logger.Debugf("DELETE Response: %s", respJson)
+	logger.Debugf("DELETE Response: status[%d], body[%s]", response.Status, response.Body)
 
 	c.Writer.WriteHeader(int(response.Status))
 	c.Writer.Write(response.Body)
 }
 
-func (s *Server) PingRPCServer(c *gin.Context) {
+// RemoveFromEvent proxies a remove participant request to TIP
+// @Summary removes a single participant from an event in TIP
+// @Produce application/json
+// @Param id path string true "event the participant is removed from"
+// @Param vismaId path string true "participant to be removed"
+// @Success 200 {string} string "Body is yet to be defined"
+// @Failure 400 {string} string "On missing id"
+// @Failure 500 {string} string "On rpc error"
+// @Router /events/id/participants/vismaId [DELETE]
+func (s *Server) RemoveFromEvent(c *gin.Context) {
+
+	id := c.Param("id")
+	vismaID := c.Param("vismaId")
+	if id == "" || vismaID == "" {
+		c.String(http.StatusBadRequest, "no id provided")
+		return
+	}
+
+	logger := requestLogger(c, logrus.Fields{"vismaActivityId": id, "vismaId": vismaID})
+	logger.Debug("Remove participant from event")
+	queued := outbox.Entry{Operation: outbox.OpRemove, ActivityID: id, VismaID: vismaID}
+	if s.queueEvent(c, queued, nil) {
+		return
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), s.RequestTimeout)
+	ctx, cancel := context.WithTimeout(tracing.Detach(c.Request.Context()), s.requestTimeout())
 	defer cancel()
-	response, err := s.RpcClient.SendGeneric(ctx, tipRPC.Generic{
-		Path: "ping",
-	})
 
+	response, err := s.RpcClient.RemoveFromEvent(ctx, id, vismaID)
 	if err != nil {
-		c.String(http.StatusInternalServerError, err.Error())
+		if s.queueEvent(c, queued, err) {
+			return
+		}
+		c.String(http.StatusInternalServerError, "Failed to remove from event: "+err.Error())
+		logger.Errorf("Failed to remove from event: %s", err.Error())
 		return
 	}
 
-	c.Status(http.StatusOK)
+	logger.Debugf("REMOVE Response: status[%d], body[%s]", response.Status, response.Body)
+
+	c.Writer.WriteHeader(tipStatus(response))
 	c.Writer.Write(response.Body)
 }
 
-func (s *Server) ConnAlive(c *gin.Context) {
+func (s *Server) PingRPCServer(c *gin.Context) {
+
+	ctx, cancel := context.WithTimeout(tracing.Detach(c.Request.Context()), s.requestTimeout())
+	defer cancel()
+	answer, err := s.RpcClient.CheckHealth(ctx)
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.String(http.StatusOK, answer)
+}
+
+// ReloadConfig re-reads the config file and applies the settings that can
+// change while running
+// @Summary reloads the config without restarting
+// @Success 200 {string} string "Config reloaded"
+// @Failure 404 {string} string "Reload not available"
+// @Failure 422 {string} string "Invalid config, or changes that need a restart"
+// @Router /admin/reload [POST]
+func (s *Server) ReloadConfig(c *gin.Context) {
+	if s.reload == nil {
+		c.String(http.StatusNotFound, "reload not available")
+		return
+	}
 
-	if !s.RpcClient.ConnOK {
-		c.String(http.StatusInternalServerError, "not connected to RPC server")
+	err := s.reload()
+	if err != nil {
+		log.FromContext(c.Request.Context()).Errorf("Config not reloaded: %s", err)
+		c.String(http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	c.String(http.StatusOK, "config reloaded")
+}
+
+// ConnAlive reports the state of the connection to the RPC server
+// @Summary reports the state of the connection to the RPC server
+// @Produce application/json
+// @Success 200 {object} rpc.ConnStatus "Connected"
+// @Failure 500 {object} rpc.ConnStatus "Not connected, with failure count and next retry"
+// @Router /alive [GET]
+func (s *Server) ConnAlive(c *gin.Context) {
+	status := s.RpcClient.Status()
+	if !status.Connected {
+		c.JSON(http.StatusInternalServerError, status)
 	} else {
-		c.String(http.StatusOK, "connected to RPC server")
+		c.JSON(http.StatusOK, status)
 	}
 }
 
-func (s *Server) Run(ctx context.Context) error {
-	if s.RequestTimeout < time.Second {
-		s.RequestTimeout = time.Second * 1
+// requestTimeout returns the current timeout for requests to TIP
+func (s *Server) requestTimeout() time.Duration {
+	timeout, _ := s.timeout.Load().(time.Duration)
+	return timeout
+}
+
+func (s *Server) setRequestTimeout(timeout time.Duration) {
+	if timeout < time.Second {
+		timeout = time.Second * 1
 		log.Logger.Warnf("RequestTimeout was not set or set to less than 1 sec. Set to 1 second")
 	}
+	s.timeout.Store(timeout)
+}
 
-	rpcCtx, cancel := context.WithCancel(ctx)
-	defer cancel()
-	go s.RpcClient.Run(rpcCtx)
+// Reload swaps in the request timeout and the reloadable settings of the rpc
+// client from next, while the api is running
+func (s *Server) Reload(next *Server) {
+	s.setRequestTimeout(next.RequestTimeout)
+	s.RpcClient.Reload(next.RpcClient)
+}
+
+// OnReload sets the function called by POST /admin/reload. Must be set before Run.
+func (s *Server) OnReload(reload func() error) {
+	s.reload = reload
+}
+
+func (s *Server) Run(ctx context.Context) error {
+	s.setRequestTimeout(s.RequestTimeout)
+
+	if s.ShutdownTimeout <= 0 {
+		s.ShutdownTimeout = defaultShutdownTimeout
+	}
+
+	// The rpc client outlives the api, so api requests in flight can finish
+	rpcCtx, cancel := context.WithCancel(context.Background())
+	rpcDone := make(chan struct{})
+	go func() {
+		s.RpcClient.Run(rpcCtx)
+		close(rpcDone)
+	}()
+	defer func() {
+		cancel()
+		<-rpcDone
+	}()
+
+	if s.Outbox.Path != "" {
+		var err error
+		s.queue, err = outbox.Open(s.Outbox.Path)
+		if err != nil {
+			return err
+		}
+		defer s.queue.Close()
+		log.Logger.Infof("Outbox at %s holds %d queued event mutations",
+			s.Outbox.Path, len(s.queue.List()))
+
+		replayDone := make(chan struct{})
+		go func() {
+			s.replayOutbox(ctx)
+			close(replayDone)
+		}()
+		defer func() { <-replayDone }()
+	}
+
+	checker := healthcheck.NewChecker(s.Health, version.VERSION)
+	checker.Add("tip", s.RpcClient.PingTIP)
+	checker.Add("flyvo", s.RpcClient.PingFlyvo)
+	if s.Health.Address != "" {
+		go func() {
+			err := healthcheck.StartHealthService(ctx, s.Health.Address, checker)
+			if err != nil {
+				log.Logger.Errorf("Health check service failed: %s", err)
+			}
+		}()
+	}
 
 	g := gin.New()
-	log.Logger.Infof("Starting gin at port %s", s.Port)
+	g.Use(instrument, trace, logRequests)
 	g.GET("/ping", s.PingRPCServer)
 	g.GET("/alive", s.ConnAlive)
-	g.POST("/generic", s.SendGenericRequest)
-	g.POST("/events", s.PostEvent)
-	g.PUT("/events", s.PutEvent)
-	g.DELETE("/events/:id", s.DeleteEvent)
-	return g.Run(":" + s.Port)
+	g.GET("/healthz", gin.WrapF(checker.Healthz))
+	g.GET("/readyz", gin.WrapF(checker.Readyz))
+	g.GET("/status", gin.WrapF(checker.StatusHandler))
+	s.Auth.replays = &replayCache{seen: map[string]time.Time{}}
+	if len(s.Auth.Credentials) == 0 {
+		log.Logger.Warn("No api credentials configured, anyone can call the api except /admin")
+	}
+	g.POST("/generic", s.authorize(ScopeGeneric), s.SendGenericRequest)
+	g.POST("/events", s.authorize(ScopeEvents), s.PostEvent)
+	g.PUT("/events", s.authorize(ScopeEvents), s.PutEvent)
+	g.DELETE("/events/:id", s.authorize(ScopeEvents), s.DeleteEvent)
+	if s.RemoveParticipant {
+		g.DELETE("/events/:id/participants/:vismaId", s.authorize(ScopeEvents), s.RemoveFromEvent)
+	}
+	g.GET("/metrics", s.authorize(ScopeMetrics), s.Metrics)
+	g.GET("/admin/outbox", s.authorize(ScopeAdmin), s.ListOutbox)
+	g.DELETE("/admin/outbox", s.authorize(ScopeAdmin), s.PurgeOutbox)
+	g.DELETE("/admin/outbox/:id", s.authorize(ScopeAdmin), s.RemoveFromOutbox)
+	g.POST("/admin/reload", s.authorize(ScopeAdmin), s.ReloadConfig)
+	return s.listen(ctx, g)
+}
+
+// listen serves the api on the configured address, with TLS if a certificate
+// is configured. When ctx is done, it stops accepting requests and waits up to
+// ShutdownTimeout for the ones in flight.
+func (s *Server) listen(ctx context.Context, handler http.Handler) error {
+	srv := &http.Server{
+		Addr:    net.JoinHostPort(s.Address, s.Port),
+		Handler: handler,
+	}
+
+	if s.TLS.CertFile == "" {
+		if !s.TLS.Empty() {
+			return errors.New("api tls is configured without certFile")
+		}
+		log.Logger.Infof("Starting gin at %s", srv.Addr)
+		return s.serve(ctx, srv, srv.ListenAndServe)
+	}
+
+	certs, err := tlsconfig.NewReloader(s.TLS)
+	if err != nil {
+		return err
+	}
+	go certs.Watch(ctx)
+
+	srv.TLSConfig = certs.ServerConfig(s.RequireCert)
+	log.Logger.Infof("Starting gin with TLS at %s", srv.Addr)
+	return s.serve(ctx, srv, func() error { return srv.ListenAndServeTLS("", "") })
+}
+
+// serve runs listenAndServe until it fails or ctx is done, then shuts srv down
+func (s *Server) serve(ctx context.Context, srv *http.Server, listenAndServe func() error) error {
+	failed := make(chan error, 1)
+	go func() {
+		failed <- listenAndServe()
+	}()
+
+	select {
+	case err := <-failed:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Logger.Infof("Shutting down api, waiting up to %s for requests in flight", s.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.ShutdownTimeout)
+	defer cancel()
+	err := srv.Shutdown(shutdownCtx)
+	if err != nil {
+		srv.Close()
+		return fmt.Errorf("api requests still in flight after %s: %w", s.ShutdownTimeout, err)
+	}
+	log.Logger.Info("Api stopped")
+	return nil
 }
@@ -0,0 +1,267 @@
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tktip/flyvo-rpc-client/internal/log"
+	"github.com/tktip/flyvo-rpc-client/internal/secret"
+)
+
+// Credential types accepted on the api
+const (
+	AuthAPIKey = "apiKey"
+	AuthBasic  = "basic"
+	AuthHMAC   = "hmac"
+	AuthMTLS   = "mtls"
+)
+
+// Scopes a credential can be granted
+const (
+	ScopeEvents  = "events"
+	ScopeGeneric = "generic"
+	ScopeAdmin   = "admin"
+	ScopeMetrics = "metrics"
+)
+
+// Headers used by api key and HMAC auth
+const (
+	HeaderAPIKey    = "X-Api-Key"
+	HeaderKeyID     = "X-Key-Id"
+	HeaderTimestamp = "X-Timestamp"
+	HeaderSignature = "X-Signature"
+)
+
+const (
+	defaultMaxClockSkew = 5 * time.Minute
+	defaultMaxBodySize  = 1 << 20
+	credentialKey       = "credential"
+)
+
+// Auth - who may call the api. With no credentials, the api is open.
+type Auth struct {
+	Credentials []Credential `yaml:"credentials"`
+	// MaxClockSkew is how old (or new) a HMAC signed request may be
+	MaxClockSkew time.Duration `yaml:"maxClockSkew"`
+	// MaxBodySize is the largest body, in bytes, read to check a HMAC signature
+	MaxBodySize int64 `yaml:"maxBodySize"`
+
+	replays *replayCache
+}
+
+// replayCache remembers HMAC signatures until their timestamp expires
+type replayCache struct {
+	lock sync.Mutex
+	seen map[string]time.Time
+}
+
+// Credential - one set of credentials and what it may access.
+//
+// apiKey: Key is sent in the X-Api-Key header.
+// basic: Username and Password are sent with HTTP basic auth.
+// hmac: the request is signed with Key. X-Key-Id is the credential Name,
+// X-Timestamp the unix time in seconds, and X-Signature the hex encoded
+// HMAC-SHA256 of "METHOD\nPATH\nTIMESTAMP\nBODY".
+// mtls: the client certificate has CommonName as its subject common name.
+//
+// Scopes lists what the credential may access (events, generic, admin, metrics),
+// and grants access to everything if empty.
+type Credential struct {
+	Name       string        `yaml:"name"`
+	Type       string        `yaml:"type"`
+	Key        secret.Secret `yaml:"key"`
+	Username   string        `yaml:"username"`
+	Password   secret.Secret `yaml:"password"`
+	CommonName string        `yaml:"commonName"`
+	Scopes     []string      `yaml:"scopes"`
+}
+
+// Validate checks that the credential has what its type needs, and only
+// known scopes
+func (cr Credential) Validate() error {
+	switch cr.Type {
+	case AuthAPIKey:
+		if cr.Key == "" {
+			return errors.New("type apiKey requires key")
+		}
+	case AuthBasic:
+		if cr.Username == "" || cr.Password == "" {
+			return errors.New("type basic requires username and password")
+		}
+	case AuthHMAC:
+		if cr.Name == "" || cr.Key == "" {
+			return errors.New("type hmac requires name and key")
+		}
+	case AuthMTLS:
+		if cr.CommonName == "" {
+			return errors.New("type mtls requires commonName")
+		}
+	default:
+		return fmt.Errorf("unknown type '%s'", cr.Type)
+	}
+
+	for _, scope := range cr.Scopes {
+		switch scope {
+		case ScopeEvents, ScopeGeneric, ScopeAdmin, ScopeMetrics:
+		default:
+			return fmt.Errorf("unknown scope '%s'", scope)
+		}
+	}
+	return nil
+}
+
+func (cr Credential) allows(scope string) bool {
+	if len(cr.Scopes) == 0 {
+		return true
+	}
+	for _, s := range cr.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize returns middleware that only lets through requests with a
+// credential granted the given scope. Without credentials everything but the
+// admin scope is open, as admin endpoints change or remove data.
+func (s *Server) authorize(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(s.Auth.Credentials) == 0 {
+			if scope == ScopeAdmin {
+				c.String(http.StatusForbidden, "admin endpoints require api.auth credentials")
+				c.Abort()
+			}
+			return
+		}
+
+		cred, ok := s.Auth.authenticate(c)
+		if !ok {
+			c.Header("WWW-Authenticate", `Basic realm="flyvo-rpc-client"`)
+			c.String(http.StatusUnauthorized, "unauthorized")
+			c.Abort()
+			return
+		}
+
+		if !cred.allows(scope) {
+			log.Logger.Warnf("Credential '%s' is not allowed to access %s", cred.Name, c.FullPath())
+			c.String(http.StatusForbidden, "forbidden")
+			c.Abort()
+			return
+		}
+		c.Set(credentialKey, cred.Name)
+	}
+}
+
+// authenticate returns the first credential the request matches
+func (a *Auth) authenticate(c *gin.Context) (Credential, bool) {
+	for _, cred := range a.Credentials {
+		var ok bool
+		switch cred.Type {
+		case AuthAPIKey:
+			ok = equal(c.GetHeader(HeaderAPIKey), cred.Key.Value())
+		case AuthBasic:
+			user, pass, found := c.Request.BasicAuth()
+			ok = found && equal(user, cred.Username) && equal(pass, cred.Password.Value())
+		case AuthHMAC:
+			ok = c.GetHeader(HeaderKeyID) == cred.Name && a.verifySignature(c, cred.Key.Value())
+		case AuthMTLS:
+			ok = peerCommonName(c.Request) == cred.CommonName
+		}
+
+		if ok {
+			return cred, true
+		}
+	}
+	return Credential{}, false
+}
+
+// verifySignature checks the HMAC signature and timestamp of a request, and
+// rejects signatures that have been seen before
+func (a *Auth) verifySignature(c *gin.Context, key string) bool {
+	timestamp := c.GetHeader(HeaderTimestamp)
+	signature := c.GetHeader(HeaderSignature)
+	if key == "" || timestamp == "" || signature == "" {
+		return false
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	skew := a.MaxClockSkew
+	if skew <= 0 {
+		skew = defaultMaxClockSkew
+	}
+	sent := time.Unix(unix, 0)
+	if time.Since(sent) > skew || time.Until(sent) > skew {
+		return false
+	}
+
+	limit := a.MaxBodySize
+	if limit <= 0 {
+		limit = defaultMaxBodySize
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, limit))
+	if err != nil {
+		return false
+	}
+	c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(c.Request.Method + "\n" + c.Request.URL.Path + "\n" + timestamp + "\n"))
+	mac.Write(body)
+	expected := hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return false
+	}
+
+	return a.replays.firstUse(signature, sent.Add(skew))
+}
+
+// firstUse records a signature until it expires, returning false if it has
+// already been used
+func (r *replayCache) firstUse(signature string, expires time.Time) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := time.Now()
+	for sig, exp := range r.seen {
+		if now.After(exp) {
+			delete(r.seen, sig)
+		}
+	}
+
+	if _, replayed := r.seen[signature]; replayed {
+		log.Logger.Warn("Rejected replayed HMAC signed request")
+		return false
+	}
+	r.seen[signature] = expires
+	return true
+}
+
+// peerCommonName returns the common name of a verified client certificate
+func peerCommonName(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
+
+func equal(given, expected string) bool {
+	if expected == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(given), []byte(expected)) == 1
+}
@@ -0,0 +1,154 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+func authServer(creds ...Credential) http.Handler {
+	s := &Server{Auth: Auth{
+		Credentials: creds,
+		replays:     &replayCache{seen: map[string]time.Time{}},
+	}}
+	g := gin.New()
+	ok := func(c *gin.Context) { c.String(http.StatusOK, "ok") }
+	g.POST("/events", s.authorize(ScopeEvents), ok)
+	g.POST("/admin/reload", s.authorize(ScopeAdmin), ok)
+	return g
+}
+
+func sign(key, method, path, timestamp, body string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(method + "\n" + path + "\n" + timestamp + "\n" + body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func signedRequest(key, timestamp, signedBody, body string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/events", strings.NewReader(body))
+	req.Header.Set(HeaderKeyID, "flyvo")
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderSignature, sign(key, http.MethodPost, "/events", timestamp, signedBody))
+	return req
+}
+
+func TestHMAC(t *testing.T) {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	old := strconv.FormatInt(time.Now().Add(-10*time.Minute).Unix(), 10)
+	future := strconv.FormatInt(time.Now().Add(10*time.Minute).Unix(), 10)
+
+	tests := []struct {
+		name string
+		req  *http.Request
+		want int
+	}{
+		{"valid", signedRequest("secret", now, "{}", "{}"), http.StatusOK},
+		{"wrong key", signedRequest("other", now, "{}", "{}"), http.StatusUnauthorized},
+		{"body changed", signedRequest("secret", now, "{}", `{"a":1}`), http.StatusUnauthorized},
+		{"too old", signedRequest("secret", old, "{}", "{}"), http.StatusUnauthorized},
+		{"too new", signedRequest("secret", future, "{}", "{}"), http.StatusUnauthorized},
+		{"bad timestamp", signedRequest("secret", "yesterday", "{}", "{}"), http.StatusUnauthorized},
+	}
+
+	handler := authServer(Credential{Name: "flyvo", Type: AuthHMAC, Key: "secret"})
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, test.req)
+		if rec.Code != test.want {
+			t.Errorf("%s: got %d, want %d", test.name, rec.Code, test.want)
+		}
+	}
+}
+
+func TestHMACBodySize(t *testing.T) {
+	s := &Server{Auth: Auth{
+		Credentials: []Credential{{Name: "flyvo", Type: AuthHMAC, Key: "secret"}},
+		MaxBodySize: 16,
+		replays:     &replayCache{seen: map[string]time.Time{}},
+	}}
+	g := gin.New()
+	g.POST("/events", s.authorize(ScopeEvents), func(c *gin.Context) { c.String(http.StatusOK, "ok") })
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"at limit", strings.Repeat("a", 16), http.StatusOK},
+		{"over limit", strings.Repeat("a", 17), http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, signedRequest("secret", now, test.body, test.body))
+		if rec.Code != test.want {
+			t.Errorf("%s: got %d, want %d", test.name, rec.Code, test.want)
+		}
+	}
+}
+
+func TestHMACReplay(t *testing.T) {
+	handler := authServer(Credential{Name: "flyvo", Type: AuthHMAC, Key: "secret"})
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	for i, want := range []int{http.StatusOK, http.StatusUnauthorized} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, signedRequest("secret", now, "{}", "{}"))
+		if rec.Code != want {
+			t.Errorf("request %d: got %d, want %d", i+1, rec.Code, want)
+		}
+	}
+
+	// the same request signed with another timestamp is a new signature
+	later := strconv.FormatInt(time.Now().Add(time.Second).Unix(), 10)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, signedRequest("secret", later, "{}", "{}"))
+	if rec.Code != http.StatusOK {
+		t.Errorf("new timestamp: got %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	apiKey := Credential{Name: "flyvo", Type: AuthAPIKey, Key: "key", Scopes: []string{ScopeEvents}}
+
+	tests := []struct {
+		name  string
+		creds []Credential
+		path  string
+		key   string
+		want  int
+		body  string
+	}{
+		{"open without credentials", nil, "/events", "", http.StatusOK, "ok"},
+		{"admin closed without credentials", nil, "/admin/reload", "",
+			http.StatusForbidden, "admin endpoints require api.auth credentials"},
+		{"api key", []Credential{apiKey}, "/events", "key", http.StatusOK, "ok"},
+		{"wrong api key", []Credential{apiKey}, "/events", "nope", http.StatusUnauthorized, "unauthorized"},
+		{"missing scope", []Credential{apiKey}, "/admin/reload", "key", http.StatusForbidden, "forbidden"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, test.path, nil)
+		if test.key != "" {
+			req.Header.Set(HeaderAPIKey, test.key)
+		}
+		rec := httptest.NewRecorder()
+		authServer(test.creds...).ServeHTTP(rec, req)
+		if rec.Code != test.want || rec.Body.String() != test.body {
+			t.Errorf("%s: got %d %q, want %d %q", test.name, rec.Code, rec.Body.String(), test.want, test.body)
+		}
+	}
+}
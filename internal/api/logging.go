@@ -0,0 +1,34 @@
+package api
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tktip/flyvo-rpc-client/internal/log"
+)
+
+// logRequests gives each api request log fields for its method and route, and
+// logs the outcome once it has been handled
+func logRequests(c *gin.Context) {
+	start := time.Now()
+	c.Request = c.Request.WithContext(log.WithFields(c.Request.Context(), logrus.Fields{
+		"method": c.Request.Method,
+		"route":  c.FullPath(),
+	}))
+
+	c.Next()
+
+	log.FromContext(c.Request.Context()).WithFields(logrus.Fields{
+		"status":   c.Writer.Status(),
+		"duration": time.Since(start).Seconds(),
+	}).Debug("Handled api request")
+}
+
+// requestLogger adds fields to every later log line of the request, and
+// returns its logger
+func requestLogger(c *gin.Context, fields logrus.Fields) *logrus.Entry {
+	ctx := log.WithFields(c.Request.Context(), fields)
+	c.Request = c.Request.WithContext(ctx)
+	return log.FromContext(ctx)
+}
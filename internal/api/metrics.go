@@ -0,0 +1,42 @@
+package api
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tktip/flyvo-rpc-client/internal/metrics"
+)
+
+var (
+	httpDuration = metrics.NewHistogram("flyvo_rpc_http_request_duration_seconds",
+		"Time taken by api requests, per route, method and status.",
+		metrics.DefaultBuckets, "route", "method", "status")
+	httpInFlight = metrics.NewGauge("flyvo_rpc_http_requests_in_flight",
+		"Api requests currently being handled.")
+)
+
+// instrument records latency and in-flight api requests
+func instrument(c *gin.Context) {
+	start := time.Now()
+	httpInFlight.Add(1)
+	defer httpInFlight.Add(-1)
+
+	c.Next()
+
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	httpDuration.Observe(time.Since(start).Seconds(),
+		route, c.Request.Method, strconv.Itoa(c.Writer.Status()))
+}
+
+// Metrics serves metrics in the Prometheus text format
+// @Summary metrics in the Prometheus text format
+// @Produce text/plain
+// @Success 200 {string} string "Metrics"
+// @Router /metrics [GET]
+func (s *Server) Metrics(c *gin.Context) {
+	metrics.Handler().ServeHTTP(c.Writer, c.Request)
+}
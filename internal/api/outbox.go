@@ -0,0 +1,207 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	tipRPC "github.com/tktip/flyvo-api/pkg/rpc"
+	"github.com/tktip/flyvo-rpc-client/internal/log"
+	"github.com/tktip/flyvo-rpc-client/internal/outbox"
+	"github.com/tktip/flyvo-rpc-client/internal/rpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// tipUnreachable returns true if a call failed because TIP could not be reached,
+// as opposed to TIP rejecting it. A call that timed out is not, as TIP may have
+// applied it before the deadline, and sending it again would apply it twice.
+func tipUnreachable(err error) bool {
+	return err == rpc.ErrorShuttingDown || status.Code(err) == codes.Unavailable
+}
+
+// queueEvent puts an event mutation in the outbox if it failed because TIP is
+// unreachable (cause), or if earlier mutations for the same activity are still
+// queued (cause is nil). Returns true if the request has been responded to.
+func (s *Server) queueEvent(c *gin.Context, entry outbox.Entry, cause error) bool {
+	if s.queue == nil {
+		return false
+	}
+	if cause == nil && !s.queue.Pending(entry.ActivityID) {
+		return false
+	}
+	if cause != nil && !tipUnreachable(cause) {
+		return false
+	}
+
+	logger := log.FromContext(c.Request.Context())
+	entry, err := s.queue.Add(entry, cause)
+	if err != nil {
+		logger.Errorf("Failed to queue %s of event %s: %s", entry.Operation, entry.ActivityID, err)
+		return false
+	}
+
+	logger.WithField("outboxId", entry.ID).Warnf("Queued %s of event %s in outbox",
+		entry.Operation, entry.ActivityID)
+	c.JSON(http.StatusAccepted, entry)
+	return true
+}
+
+// sendEvent sends a queued event mutation to TIP
+func (s *Server) sendEvent(ctx context.Context, entry outbox.Entry) (*tipRPC.Generic, error) {
+	switch entry.Operation {
+	case outbox.OpPublish:
+		return s.RpcClient.PostEvent(ctx, entry.Event)
+	case outbox.OpUpdate:
+		return s.RpcClient.PutEvent(ctx, entry.Event)
+	case outbox.OpRemove:
+		return s.RpcClient.RemoveFromEvent(ctx, entry.ActivityID, entry.VismaID)
+	default:
+		return s.RpcClient.DeleteEvent(ctx, entry.ActivityID)
+	}
+}
+
+// replayOutbox sends queued mutations whenever TIP is connected, until ctx is done
+func (s *Server) replayOutbox(ctx context.Context) {
+	ticker := time.NewTicker(s.Outbox.Interval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if s.RpcClient.Status().Connected {
+			s.replayQueued(ctx)
+		}
+	}
+}
+
+// replayQueued sends queued mutations, oldest first per activity, until the
+// outbox is empty, no more can be sent or ctx is done. Mutations TIP rejects,
+// or that have failed too many times, are moved to the dead letter so later
+// mutations for the same activity are not held back for good.
+func (s *Server) replayQueued(ctx context.Context) {
+	for {
+		heads := s.queue.Heads()
+		done := 0
+		for _, entry := range heads {
+			if ctx.Err() != nil {
+				return
+			}
+			logger := log.Logger.WithFields(logrus.Fields{
+				"vismaActivityId": entry.ActivityID,
+				"outboxId":        entry.ID,
+			})
+			ctx, cancel := context.WithTimeout(context.Background(), s.requestTimeout())
+			response, err := s.sendEvent(ctx, entry)
+			cancel()
+			if err == nil && response.Status >= http.StatusBadRequest {
+				err = fmt.Errorf("rejected by TIP with status %d: %s", response.Status, response.Body)
+			}
+
+			unreachable := err != nil && tipUnreachable(err)
+			switch {
+			case err == nil:
+				logger.Infof("Replayed %s of event", entry.Operation)
+				_, err = s.queue.Remove(entry.ID)
+				if err != nil {
+					logger.Errorf("Failed to remove replayed entry from outbox: %s", err)
+					return
+				}
+				done++
+				continue
+			case unreachable && entry.Attempts+1 < s.Outbox.AttemptLimit():
+				logger.Warnf("Failed to replay %s of event: %s", entry.Operation, err)
+				err = s.queue.Failed(entry.ID, err)
+			default:
+				logger.Errorf("Failed to replay %s of event, moved to the dead letter: %s",
+					entry.Operation, err)
+				err = s.queue.DeadLetter(entry.ID, err)
+				done++
+			}
+			if err != nil {
+				logger.Errorf("Failed to update outbox: %s", err)
+				return
+			}
+			if unreachable {
+				return
+			}
+		}
+
+		if done == 0 {
+			return
+		}
+	}
+}
+
+// ListOutbox lists queued event mutations
+// @Summary lists event mutations waiting to be sent to TIP
+// @Produce application/json
+// @Success 200 {array} outbox.Entry "Queued mutations, oldest first"
+// @Failure 404 {string} string "Outbox not enabled"
+// @Router /admin/outbox [GET]
+func (s *Server) ListOutbox(c *gin.Context) {
+	if s.queue == nil {
+		c.String(http.StatusNotFound, "outbox not enabled")
+		return
+	}
+	c.JSON(http.StatusOK, s.queue.List())
+}
+
+// PurgeOutbox removes every queued event mutation
+// @Summary removes every event mutation waiting to be sent to TIP
+// @Success 204 "Outbox purged"
+// @Failure 404 {string} string "Outbox not enabled"
+// @Failure 500 {string} string "On outbox file error"
+// @Router /admin/outbox [DELETE]
+func (s *Server) PurgeOutbox(c *gin.Context) {
+	if s.queue == nil {
+		c.String(http.StatusNotFound, "outbox not enabled")
+		return
+	}
+
+	err := s.queue.Purge()
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Logger.Warn("Outbox purged")
+	c.Status(http.StatusNoContent)
+}
+
+// RemoveFromOutbox removes one queued event mutation
+// @Summary removes an event mutation waiting to be sent to TIP
+// @Param id path string true "outbox entry id"
+// @Success 204 "Entry removed"
+// @Failure 404 {string} string "No such entry, or outbox not enabled"
+// @Failure 500 {string} string "On outbox file error"
+// @Router /admin/outbox/id [DELETE]
+func (s *Server) RemoveFromOutbox(c *gin.Context) {
+	if s.queue == nil {
+		c.String(http.StatusNotFound, "outbox not enabled")
+		return
+	}
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.String(http.StatusBadRequest, "bad id")
+		return
+	}
+
+	found, err := s.queue.Remove(id)
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	} else if !found {
+		c.String(http.StatusNotFound, "no such entry")
+		return
+	}
+	log.Logger.Warnf("Entry %d removed from outbox", id)
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,31 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/tktip/flyvo-rpc-client/internal/rpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestTipUnreachable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{status.Error(codes.Unavailable, "connection refused"), true},
+		{rpc.ErrorShuttingDown, true},
+		{status.Error(codes.DeadlineExceeded, "deadline exceeded"), false},
+		{context.DeadlineExceeded, false},
+		{status.Error(codes.InvalidArgument, "bad event"), false},
+		{errors.New("other"), false},
+	}
+
+	for _, test := range tests {
+		if got := tipUnreachable(test.err); got != test.want {
+			t.Errorf("%v: got %t, want %t", test.err, got, test.want)
+		}
+	}
+}
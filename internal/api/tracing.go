@@ -0,0 +1,36 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tktip/flyvo-rpc-client/internal/tracing"
+)
+
+// trace records a span for each api request, continuing the caller's trace if
+// it sent a traceparent header. Handlers pass the span on to TIP through the
+// request context.
+func trace(c *gin.Context) {
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+
+	ctx := tracing.Extract(c.Request.Context(), c.GetHeader(tracing.TraceparentHeader))
+	ctx, span := tracing.Start(ctx, c.Request.Method+" "+route, tracing.KindServer)
+	defer span.End()
+	span.SetAttribute("http.method", c.Request.Method)
+	span.SetAttribute("http.route", route)
+	c.Request = c.Request.WithContext(ctx)
+
+	c.Next()
+
+	status := c.Writer.Status()
+	span.SetAttribute("http.status_code", status)
+	if errs := c.Errors.ByType(gin.ErrorTypeAny); len(errs) > 0 {
+		span.SetError(errors.New(errs.String()))
+	} else if status >= 500 {
+		span.SetError(errors.New(http.StatusText(status)))
+	}
+}
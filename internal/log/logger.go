@@ -1,9 +1,57 @@
 package log
 
-import "github.com/sirupsen/logrus"
+import (
+	"context"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Log formats
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
 
 var Logger *logrus.Logger
 
+type fieldsKey struct{}
+
 func init() {
 	Logger = logrus.New()
 }
+
+// SetFormat switches between text (default) and json output. JSON lines carry
+// request-scoped fields as top level keys, for log shipping without parsing.
+func SetFormat(format string) error {
+	switch format {
+	case "", FormatText:
+		Logger.SetFormatter(&logrus.TextFormatter{})
+	case FormatJSON:
+		Logger.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown log format '%s'", format)
+	}
+	return nil
+}
+
+// WithFields returns a context carrying fields that are added to every line
+// logged through FromContext, on top of the fields ctx already carries
+func WithFields(ctx context.Context, fields logrus.Fields) context.Context {
+	merged := logrus.Fields{}
+	if existing, ok := ctx.Value(fieldsKey{}).(logrus.Fields); ok {
+		for key, value := range existing {
+			merged[key] = value
+		}
+	}
+	for key, value := range fields {
+		merged[key] = value
+	}
+	return context.WithValue(ctx, fieldsKey{}, merged)
+}
+
+// FromContext returns a log entry with the fields carried by ctx
+func FromContext(ctx context.Context) *logrus.Entry {
+	fields, _ := ctx.Value(fieldsKey{}).(logrus.Fields)
+	return Logger.WithFields(fields)
+}
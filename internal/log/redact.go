@@ -0,0 +1,223 @@
+package log
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tktip/flyvo-rpc-client/internal/secret"
+)
+
+// Redaction modes
+const (
+	RedactMask = "mask"
+	RedactHash = "hash"
+	RedactNone = "none"
+)
+
+const masked = "***"
+
+// DefaultRedactedFields are the personal data fields in TIP and FLYVO bodies
+var DefaultRedactedFields = []string{"givenName", "surname", "vismaId", "absenceCode", "absentees"}
+
+// Redaction - which JSON fields are hidden from every log line, and how.
+// Values are masked (default) or replaced by a hash, which still lets lines
+// about the same person be correlated. Salt makes the hash a HMAC, so short
+// values like ids can't be recovered by hashing every candidate.
+type Redaction struct {
+	Fields []string      `yaml:"fields"`
+	Mode   string        `yaml:"mode"`
+	Salt   secret.Secret `yaml:"salt"`
+}
+
+// redactHook rewrites entries before they are formatted or passed to any other
+// hook. It is added first, so every sink sees the redacted entry.
+type redactHook struct {
+	lock    sync.RWMutex
+	mode    string
+	salt    []byte
+	fields  map[string]bool
+	pattern *regexp.Regexp
+}
+
+var redactor = &redactHook{}
+
+func init() {
+	redactor.set(RedactMask, nil, DefaultRedactedFields)
+	Logger.AddHook(redactor)
+}
+
+// SetRedaction replaces the redaction rules
+func SetRedaction(r Redaction) error {
+	mode := r.Mode
+	switch mode {
+	case "":
+		mode = RedactMask
+	case RedactMask, RedactHash, RedactNone:
+	default:
+		return fmt.Errorf("unknown redaction mode '%s'", r.Mode)
+	}
+
+	fields := r.Fields
+	if len(fields) == 0 {
+		fields = DefaultRedactedFields
+	}
+	var salt []byte
+	if r.Salt != "" {
+		salt = []byte(r.Salt.Value())
+	}
+	redactor.set(mode, salt, fields)
+	return nil
+}
+
+func (h *redactHook) set(mode string, salt []byte, fields []string) {
+	names := make([]string, 0, len(fields))
+	lookup := map[string]bool{}
+	for _, field := range fields {
+		names = append(names, regexp.QuoteMeta(field))
+		lookup[strings.ToLower(field)] = true
+	}
+
+	// "field": up to its value, also when the json is itself escaped inside a string
+	pattern := regexp.MustCompile(`\\?"(?i:` + strings.Join(names, "|") + `)\\?"\s*:\s*`)
+
+	h.lock.Lock()
+	h.mode = mode
+	h.salt = salt
+	h.fields = lookup
+	h.pattern = pattern
+	h.lock.Unlock()
+}
+
+func (h *redactHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *redactHook) Fire(entry *logrus.Entry) error {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	if h.mode == RedactNone {
+		return nil
+	}
+
+	entry.Message = h.redactMessage(entry.Message)
+
+	for key, value := range entry.Data {
+		if h.fields[strings.ToLower(key)] {
+			entry.Data[key] = h.replace(fmt.Sprint(value))
+		}
+	}
+	return nil
+}
+
+// redactMessage replaces the values of sensitive fields in the json in message.
+// Arrays and objects are replaced as a whole.
+func (h *redactHook) redactMessage(message string) string {
+	var out strings.Builder
+	last := 0
+	for _, loc := range h.pattern.FindAllStringIndex(message, -1) {
+		if loc[0] < last {
+			// inside a value that has been replaced
+			continue
+		}
+		escaped := message[loc[0]] == '\\'
+		end := valueEnd(message, loc[1], escaped)
+		if end < 0 {
+			continue
+		}
+
+		quote := `"`
+		if escaped {
+			quote = `\"`
+		}
+		value := strings.Trim(message[loc[1]:end], `\"`)
+		out.WriteString(message[last:loc[1]])
+		out.WriteString(quote + h.replace(value) + quote)
+		last = end
+	}
+	out.WriteString(message[last:])
+	return out.String()
+}
+
+// scalar - a json number or boolean
+var scalar = regexp.MustCompile(`^(-?[0-9][0-9.eE+-]*|true|false)`)
+
+// valueEnd returns where the json value starting at s[start] ends, or -1 if
+// there is none (or it is null). A value that is cut off ends with s. If
+// escaped, the json is itself inside a string, so its quotes are \" and its
+// backslashes \\.
+func valueEnd(s string, start int, escaped bool) int {
+	if start >= len(s) {
+		return -1
+	}
+	quote := `"`
+	if escaped {
+		quote = `\"`
+	}
+
+	depth := 0
+	inString := false
+	for i := start; i < len(s); {
+		switch {
+		case inString && s[i] == '\\' && escaped && strings.HasPrefix(s[i:], `\\`):
+			// an escape in the escaped json: \\ and the escaped character
+			i += 2
+			if i < len(s) && s[i] == '\\' {
+				i++
+			}
+			i++
+			continue
+		case inString && s[i] == '\\' && !escaped:
+			i += 2
+			continue
+		case strings.HasPrefix(s[i:], quote):
+			i += len(quote)
+			inString = !inString
+			if !inString && depth == 0 {
+				return i
+			}
+			continue
+		case inString:
+		case s[i] == '[' || s[i] == '{':
+			depth++
+		case s[i] == ']' || s[i] == '}':
+			depth--
+			if depth == 0 {
+				return i + 1
+			} else if depth < 0 {
+				return -1
+			}
+		case depth == 0:
+			n := len(scalar.FindString(s[i:]))
+			if n == 0 {
+				return -1
+			}
+			return i + n
+		}
+		i++
+	}
+	return len(s)
+}
+
+// replace returns what a sensitive value is logged as
+func (h *redactHook) replace(value string) string {
+	if h.mode != RedactHash {
+		return masked
+	}
+
+	var sum []byte
+	if h.salt != nil {
+		mac := hmac.New(sha256.New, h.salt)
+		mac.Write([]byte(value))
+		sum = mac.Sum(nil)
+	} else {
+		s := sha256.Sum256([]byte(value))
+		sum = s[:]
+	}
+	return "sha256:" + hex.EncodeToString(sum[:6])
+}
@@ -0,0 +1,102 @@
+package log
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func hashed(value string, salt []byte) string {
+	if salt == nil {
+		sum := sha256.Sum256([]byte(value))
+		return "sha256:" + hex.EncodeToString(sum[:6])
+	}
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte(value))
+	return "sha256:" + hex.EncodeToString(mac.Sum(nil)[:6])
+}
+
+func TestRedact(t *testing.T) {
+	salt := []byte("salt")
+	tests := []struct {
+		name    string
+		mode    string
+		salt    []byte
+		message string
+		want    string
+	}{
+		{"plain", RedactMask, nil,
+			`body {"vismaId": "123", "title": "Math", "givenName":"Ola"}`,
+			`body {"vismaId": "***", "title": "Math", "givenName":"***"}`},
+		{"escaped", RedactMask, nil,
+			`body "{\"vismaId\":\"123\",\"title\":\"Math\"}"`,
+			`body "{\"vismaId\":\"***\",\"title\":\"Math\"}"`},
+		{"case insensitive", RedactMask, nil, `{"VismaID":"123"}`, `{"VismaID":"***"}`},
+		{"number", RedactMask, nil, `{"vismaId": 123, "n": 1}`, `{"vismaId": "***", "n": 1}`},
+		{"quotes in value", RedactMask, nil, `{"surname":"O\"Neil","x":"y"}`, `{"surname":"***","x":"y"}`},
+		{"array", RedactMask, nil,
+			`{"absentees":["1","2"],"vismaActivityId":"a"}`, `{"absentees":"***","vismaActivityId":"a"}`},
+		{"array escaped", RedactMask, nil,
+			`"{\"absentees\": [\"1\", \"a]\\\"\"], \"x\":1}"`, `"{\"absentees\": \"***\", \"x\":1}"`},
+		{"object", RedactMask, nil,
+			`{"vismaId":{"id":"1","vismaId":"2","n":[1]},"x":"}"}`, `{"vismaId":"***","x":"}"}`},
+		{"nested objects", RedactMask, nil,
+			`{"participants":[{"vismaId":"1","givenName":"Ola"},{"vismaId":2}]}`,
+			`{"participants":[{"vismaId":"***","givenName":"***"},{"vismaId":"***"}]}`},
+		{"array hashed", RedactHash, nil, `{"absentees":["1"]}`, `{"absentees":"` + hashed(`["1"]`, nil) + `"}`},
+		{"null kept", RedactMask, nil, `{"vismaId":null}`, `{"vismaId":null}`},
+		{"cut off", RedactMask, nil, `{"absentees":["1",`, `{"absentees":"***"`},
+		{"other fields kept", RedactMask, nil, `{"title":"vismaId"}`, `{"title":"vismaId"}`},
+		{"hash", RedactHash, nil, `{"vismaId":"123"}`, `{"vismaId":"` + hashed("123", nil) + `"}`},
+		{"hash escaped", RedactHash, nil, `{\"vismaId\":\"123\"}`, `{\"vismaId\":\"` + hashed("123", nil) + `\"}`},
+		{"hmac", RedactHash, salt, `{"vismaId":"123"}`, `{"vismaId":"` + hashed("123", salt) + `"}`},
+		{"none", RedactNone, nil, `{"vismaId":"123"}`, `{"vismaId":"123"}`},
+	}
+
+	for _, test := range tests {
+		h := &redactHook{}
+		h.set(test.mode, test.salt, DefaultRedactedFields)
+		entry := &logrus.Entry{Message: test.message, Data: logrus.Fields{}}
+		if err := h.Fire(entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry.Message != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, entry.Message, test.want)
+		}
+	}
+}
+
+func TestRedactFields(t *testing.T) {
+	tests := []struct {
+		mode string
+		want interface{}
+	}{
+		{RedactMask, masked},
+		{RedactHash, hashed("123", nil)},
+		{RedactNone, 123},
+	}
+
+	for _, test := range tests {
+		h := &redactHook{}
+		h.set(test.mode, nil, DefaultRedactedFields)
+		entry := &logrus.Entry{Data: logrus.Fields{"vismaId": 123, "path": "getAbsences"}}
+		if err := h.Fire(entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry.Data["vismaId"] != test.want {
+			t.Errorf("%s: got vismaId %v, want %v", test.mode, entry.Data["vismaId"], test.want)
+		}
+		if entry.Data["path"] != "getAbsences" {
+			t.Errorf("%s: got path %v, want it kept", test.mode, entry.Data["path"])
+		}
+	}
+}
+
+func TestSetRedaction(t *testing.T) {
+	if err := SetRedaction(Redaction{Mode: "scramble"}); err == nil {
+		t.Error("unknown mode: got no error")
+	}
+}
@@ -0,0 +1,302 @@
+// Package metrics keeps counters, gauges and histograms, and serves them in
+// the Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are histogram buckets in seconds, suited for request latency
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+var (
+	registryLock sync.Mutex
+	registry     []collector
+)
+
+type collector interface {
+	write(w io.Writer)
+}
+
+func register(c collector) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	registry = append(registry, c)
+}
+
+// desc - what every metric has in common
+type desc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (d desc) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, escapeHelp(d.help), d.name, d.kind)
+}
+
+// key joins label values into a map key
+func (d desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metric %s wants %d label values, got %d",
+			d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// labelString formats label pairs, with extra pairs appended
+func (d desc) labelString(key string, extra ...string) string {
+	pairs := []string{}
+	if len(d.labels) > 0 {
+		values := strings.Split(key, "\xff")
+		for i, label := range d.labels {
+			pairs = append(pairs, label+`="`+escape(values[i])+`"`)
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escape(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// escapeHelp escapes HELP text, in which quotes are kept as is
+func escapeHelp(help string) string {
+	help = strings.Replace(help, `\`, `\\`, -1)
+	return strings.Replace(help, "\n", `\n`, -1)
+}
+
+// escape escapes a label value
+func escape(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, "\n", `\n`, -1)
+	return strings.Replace(value, `"`, `\"`, -1)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Counter - a value that only goes up, per combination of label values
+type Counter struct {
+	desc
+	lock   sync.Mutex
+	values map[string]float64
+}
+
+// NewCounter creates and registers a counter
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{
+		desc:   desc{name: name, help: help, kind: "counter", labels: labels},
+		values: map[string]float64{},
+	}
+	if len(labels) == 0 {
+		c.values[""] = 0
+	}
+	register(c)
+	return c
+}
+
+// Inc adds one to the counter for the given label values
+func (c *Counter) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+// Add adds v to the counter for the given label values
+func (c *Counter) Add(v float64, labels ...string) {
+	key := c.key(labels)
+	c.lock.Lock()
+	c.values[key] += v
+	c.lock.Unlock()
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.header(w)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelString(key), formatFloat(c.values[key]))
+	}
+}
+
+// Gauge - a value that can go up and down, per combination of label values
+type Gauge struct {
+	desc
+	lock   sync.Mutex
+	values map[string]float64
+}
+
+// NewGauge creates and registers a gauge
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{
+		desc:   desc{name: name, help: help, kind: "gauge", labels: labels},
+		values: map[string]float64{},
+	}
+	if len(labels) == 0 {
+		g.values[""] = 0
+	}
+	register(g)
+	return g
+}
+
+// Set sets the gauge for the given label values
+func (g *Gauge) Set(v float64, labels ...string) {
+	key := g.key(labels)
+	g.lock.Lock()
+	g.values[key] = v
+	g.lock.Unlock()
+}
+
+// Add adds v (which may be negative) to the gauge for the given label values
+func (g *Gauge) Add(v float64, labels ...string) {
+	key := g.key(labels)
+	g.lock.Lock()
+	g.values[key] += v
+	g.lock.Unlock()
+}
+
+func (g *Gauge) write(w io.Writer) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.header(w)
+	for _, key := range sortedKeys(g.values) {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, g.labelString(key), formatFloat(g.values[key]))
+	}
+}
+
+// GaugeFunc - a gauge without labels, whose value is read when scraped
+type GaugeFunc struct {
+	desc
+	value func() float64
+}
+
+// NewGaugeFunc creates and registers a gauge read from value
+func NewGaugeFunc(name, help string, value func() float64) *GaugeFunc {
+	g := &GaugeFunc{
+		desc:  desc{name: name, help: help, kind: "gauge"},
+		value: value,
+	}
+	register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	g.header(w)
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.value()))
+}
+
+// Histogram - counts observations in buckets, per combination of label values
+type Histogram struct {
+	desc
+	buckets []float64
+	lock    sync.Mutex
+	series  map[string]*series
+}
+
+type series struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram creates and registers a histogram with the given upper bounds
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	sorted := append([]float64{}, buckets...)
+	sort.Float64s(sorted)
+	h := &Histogram{
+		desc:    desc{name: name, help: help, kind: "histogram", labels: labels},
+		buckets: sorted,
+		series:  map[string]*series{},
+	}
+	register(h)
+	return h
+}
+
+// Observe records v for the given label values
+func (h *Histogram) Observe(v float64, labels ...string) {
+	key := h.key(labels)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &series{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.header(w)
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := h.series[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n",
+				h.name, h.labelString(key, "le", formatFloat(bound)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(key, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelString(key), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelString(key), s.count)
+	}
+}
+
+// WriteTo writes every registered metric in the text exposition format
+func WriteTo(w io.Writer) {
+	registryLock.Lock()
+	collectors := append([]collector{}, registry...)
+	registryLock.Unlock()
+
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
+
+// Handler serves every registered metric
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteTo(w)
+	})
+}
@@ -0,0 +1,116 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func output(c collector) string {
+	var buf bytes.Buffer
+	c.write(&buf)
+	return buf.String()
+}
+
+func TestCounter(t *testing.T) {
+	c := NewCounter("test_requests_total", "Requests.\nBy path, with \\ in it.", "path", "status")
+	c.Inc("/b", "200")
+	c.Add(2, "/a", "200")
+	c.Inc("a\"b\\c\nd", "500")
+
+	want := `# HELP test_requests_total Requests.\nBy path, with \\ in it.
+# TYPE test_requests_total counter
+test_requests_total{path="/a",status="200"} 2
+test_requests_total{path="/b",status="200"} 1
+test_requests_total{path="a\"b\\c\nd",status="500"} 1
+`
+	if got := output(c); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestCounterWithoutLabels(t *testing.T) {
+	c := NewCounter("test_reconnects_total", `Reconnects, "quoted".`)
+
+	want := `# HELP test_reconnects_total Reconnects, "quoted".
+# TYPE test_reconnects_total counter
+test_reconnects_total 0
+`
+	if got := output(c); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestGauge(t *testing.T) {
+	g := NewGauge("test_in_flight", "In flight.", "kind")
+	g.Set(3, "tip")
+	g.Add(-1.5, "tip")
+	g.Set(math.Inf(1), "flyvo")
+	f := NewGaugeFunc("test_seconds", "Seconds.", func() float64 { return 1e21 })
+
+	want := `# HELP test_in_flight In flight.
+# TYPE test_in_flight gauge
+test_in_flight{kind="flyvo"} +Inf
+test_in_flight{kind="tip"} 1.5
+# HELP test_seconds Seconds.
+# TYPE test_seconds gauge
+test_seconds 1e+21
+`
+	if got := output(g) + output(f); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram("test_duration_seconds", "Duration.", []float64{1, 0.1, 0.5}, "route")
+	h.Observe(0.05, "/events")
+	h.Observe(0.1, "/events")
+	h.Observe(0.7, "/events")
+	h.Observe(3, "/events")
+	h.Observe(0.2, "/generic")
+
+	want := `# HELP test_duration_seconds Duration.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{route="/events",le="0.1"} 2
+test_duration_seconds_bucket{route="/events",le="0.5"} 2
+test_duration_seconds_bucket{route="/events",le="1"} 3
+test_duration_seconds_bucket{route="/events",le="+Inf"} 4
+test_duration_seconds_sum{route="/events"} 3.85
+test_duration_seconds_count{route="/events"} 4
+test_duration_seconds_bucket{route="/generic",le="0.1"} 0
+test_duration_seconds_bucket{route="/generic",le="0.5"} 1
+test_duration_seconds_bucket{route="/generic",le="1"} 1
+test_duration_seconds_bucket{route="/generic",le="+Inf"} 1
+test_duration_seconds_sum{route="/generic"} 0.2
+test_duration_seconds_count{route="/generic"} 1
+`
+	if got := output(h); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestLabelCount(t *testing.T) {
+	c := NewCounter("test_labels_total", "Labels.", "a", "b")
+	defer func() {
+		if recover() == nil {
+			t.Error("wrong number of label values: got no panic")
+		}
+	}()
+	c.Inc("only a")
+}
+
+func TestHandler(t *testing.T) {
+	NewCounter("test_handler_total", "Handler.").Inc()
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if got := rec.Header().Get("Content-Type"); got != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("got content type %s", got)
+	}
+	if !strings.Contains(rec.Body.String(), "# TYPE test_handler_total counter\ntest_handler_total 1\n") {
+		t.Errorf("got\n%s\nwant test_handler_total in it", rec.Body.String())
+	}
+}
@@ -0,0 +1,365 @@
+// Package outbox keeps event mutations that could not be sent to TIP in an
+// append-only file, so they can be replayed once TIP is reachable again.
+package outbox
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	tipRPC "github.com/tktip/flyvo-api/pkg/rpc"
+	"github.com/tktip/flyvo-rpc-client/internal/log"
+)
+
+// Operations that can be queued
+const (
+	OpPublish = "publish"
+	OpUpdate  = "update"
+	OpDelete  = "delete"
+	OpRemove  = "removeParticipant"
+)
+
+const (
+	defaultReplayInterval = 10 * time.Second
+	defaultMaxAttempts    = 10
+
+	// the file is rewritten once it holds this many records more than entries
+	compactThreshold = 1000
+)
+
+// ErrorClosed - the outbox has been closed
+var ErrorClosed = errors.New("outbox is closed")
+
+// Config - where the outbox is stored and how often it is replayed.
+// The outbox is disabled if Path is not set. Entries that have failed
+// MaxAttempts times are moved to the dead letter.
+type Config struct {
+	Path           string        `yaml:"path"`
+	ReplayInterval time.Duration `yaml:"replayInterval"`
+	MaxAttempts    int           `yaml:"maxAttempts"`
+}
+
+// Interval returns how often the outbox should be replayed
+func (c Config) Interval() time.Duration {
+	if c.ReplayInterval <= 0 {
+		return defaultReplayInterval
+	}
+	return c.ReplayInterval
+}
+
+// AttemptLimit returns how many times an entry is sent before it is moved to
+// the dead letter
+func (c Config) AttemptLimit() int {
+	if c.MaxAttempts <= 0 {
+		return defaultMaxAttempts
+	}
+	return c.MaxAttempts
+}
+
+// Entry - an event mutation waiting to be sent to TIP. Entries in the dead
+// letter are kept for inspection, but no longer sent and no longer hold back
+// later mutations for the same activity.
+type Entry struct {
+	ID         uint64        `json:"id"`
+	Operation  string        `json:"operation"`
+	ActivityID string        `json:"vismaActivityId"`
+	Event      *tipRPC.Event `json:"event,omitempty"`
+	VismaID    string        `json:"vismaId,omitempty"`
+	Queued     time.Time     `json:"queued"`
+	Attempts   int           `json:"attempts"`
+	LastError  string        `json:"lastError,omitempty"`
+	DeadLetter bool          `json:"deadLetter,omitempty"`
+}
+
+// record - one line in the outbox file
+type record struct {
+	Add    *Entry  `json:"add,omitempty"`
+	Remove *uint64 `json:"remove,omitempty"`
+	Purge  bool    `json:"purge,omitempty"`
+	NextID uint64  `json:"next,omitempty"`
+}
+
+// Outbox - queued event mutations, ordered by when they were queued
+type Outbox struct {
+	path    string
+	lock    sync.Mutex
+	file    *os.File
+	entries []Entry
+	nextID  uint64
+	records int
+}
+
+// Open opens (or creates) the outbox file at path and loads what's in it
+func Open(path string) (*Outbox, error) {
+	o := &Outbox{path: path, nextID: 1}
+	err := o.load()
+	if err != nil {
+		return nil, err
+	}
+
+	o.file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// load reads the records in the file. A partly written last line, from a
+// crash while writing it, is cut off so later records are not appended to it.
+// Other lines that can't be read are skipped, keeping the records after them.
+func (o *Outbox) load() error {
+	file, err := os.OpenFile(o.path, os.O_RDWR, 0600)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var good int64
+	for n := 1; ; n++ {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return nil
+		} else if err == io.EOF {
+			// nothing is written after a torn record, so it is the last one
+			log.Logger.Warnf("Cut off partly written record at line %d of outbox %s", n, o.path)
+			return file.Truncate(good)
+		} else if err != nil {
+			return err
+		}
+		good += int64(len(line))
+
+		rec := record{}
+		err = json.Unmarshal(bytes.TrimSpace(line), &rec)
+		if err != nil {
+			log.Logger.Errorf("Skipped unreadable record at line %d of outbox %s: %s", n, o.path, err)
+			continue
+		}
+		o.apply(rec)
+		o.records++
+	}
+}
+
+func (o *Outbox) apply(rec record) {
+	if rec.NextID > o.nextID {
+		o.nextID = rec.NextID
+	}
+
+	switch {
+	case rec.Purge:
+		o.entries = nil
+	case rec.Remove != nil:
+		o.remove(*rec.Remove)
+	case rec.Add != nil:
+		o.remove(rec.Add.ID)
+		o.entries = append(o.entries, *rec.Add)
+		sort.SliceStable(o.entries, func(i, j int) bool {
+			return o.entries[i].ID < o.entries[j].ID
+		})
+		if rec.Add.ID >= o.nextID {
+			o.nextID = rec.Add.ID + 1
+		}
+	}
+}
+
+func (o *Outbox) remove(id uint64) bool {
+	for i, entry := range o.entries {
+		if entry.ID == id {
+			o.entries = append(o.entries[:i], o.entries[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// write appends a record to the file and applies it
+func (o *Outbox) write(rec record) error {
+	if o.file == nil {
+		return ErrorClosed
+	}
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = o.file.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	err = o.file.Sync()
+	if err != nil {
+		return err
+	}
+
+	o.apply(rec)
+	o.records++
+	if o.records-len(o.entries) > compactThreshold {
+		return o.compact()
+	}
+	return nil
+}
+
+// compact rewrites the file with only the current entries
+func (o *Outbox) compact() error {
+	tmp := o.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	// keep ids unique even if every entry has been removed
+	writer := bufio.NewWriter(file)
+	next, _ := json.Marshal(record{NextID: o.nextID})
+	writer.Write(append(next, '\n'))
+	for i := range o.entries {
+		line, err := json.Marshal(record{Add: &o.entries[i]})
+		if err != nil {
+			file.Close()
+			return err
+		}
+		writer.Write(append(line, '\n'))
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	// Closed first, as an open file can't be replaced on Windows
+	o.file.Close()
+	renameErr := os.Rename(tmp, o.path)
+	// reopened either way, keeping the original file if it wasn't replaced
+	o.file, err = os.OpenFile(o.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if renameErr != nil {
+		os.Remove(tmp)
+		return renameErr
+	}
+	if err != nil {
+		o.file = nil
+		return err
+	}
+	o.records = len(o.entries) + 1
+	return nil
+}
+
+// Add queues an event mutation. The id and queue time are set by the outbox.
+func (o *Outbox) Add(entry Entry, cause error) (Entry, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	entry.ID = o.nextID
+	entry.Queued = time.Now()
+	if cause != nil {
+		entry.LastError = cause.Error()
+	}
+	return entry, o.write(record{Add: &entry})
+}
+
+// Failed records a failed attempt at sending an entry. Does nothing if the
+// entry has been removed in the meantime.
+func (o *Outbox) Failed(id uint64, cause error) error {
+	return o.failed(id, cause, false)
+}
+
+// DeadLetter records a failed attempt at sending an entry, and moves it to the
+// dead letter. Does nothing if the entry has been removed in the meantime.
+func (o *Outbox) DeadLetter(id uint64, cause error) error {
+	return o.failed(id, cause, true)
+}
+
+func (o *Outbox) failed(id uint64, cause error, dead bool) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	for _, entry := range o.entries {
+		if entry.ID == id {
+			entry.Attempts++
+			entry.LastError = cause.Error()
+			entry.DeadLetter = dead
+			return o.write(record{Add: &entry})
+		}
+	}
+	return nil
+}
+
+// Remove removes an entry, returning false if there was no such entry
+func (o *Outbox) Remove(id uint64) (bool, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	for _, entry := range o.entries {
+		if entry.ID == id {
+			return true, o.write(record{Remove: &id})
+		}
+	}
+	return false, nil
+}
+
+// Purge removes every entry
+func (o *Outbox) Purge() error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.write(record{Purge: true})
+}
+
+// List returns every entry, including the dead letter, oldest first
+func (o *Outbox) List() []Entry {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return append([]Entry{}, o.entries...)
+}
+
+// Pending returns true if there are queued entries for the activity, in which
+// case new mutations for it must be queued behind them to keep the order
+func (o *Outbox) Pending(activityID string) bool {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	for _, entry := range o.entries {
+		if entry.ActivityID == activityID && !entry.DeadLetter {
+			return true
+		}
+	}
+	return false
+}
+
+// Heads returns the oldest entry for each activity, oldest first, leaving out
+// the dead letter
+func (o *Outbox) Heads() []Entry {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	seen := map[string]bool{}
+	heads := []Entry{}
+	for _, entry := range o.entries {
+		if !entry.DeadLetter && !seen[entry.ActivityID] {
+			seen[entry.ActivityID] = true
+			heads = append(heads, entry)
+		}
+	}
+	return heads
+}
+
+// Close closes the outbox file
+func (o *Outbox) Close() error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if o.file == nil {
+		return nil
+	}
+	err := o.file.Close()
+	o.file = nil
+	return err
+}
@@ -0,0 +1,224 @@
+package outbox
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// tempPath returns an outbox path in a new directory, removed by cleanup
+func tempPath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "outbox.jsonl"), func() { os.RemoveAll(dir) }
+}
+
+func open(t *testing.T, path string) *Outbox {
+	o, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+func add(t *testing.T, o *Outbox, activityID string) Entry {
+	entry, err := o.Add(Entry{Operation: OpDelete, ActivityID: activityID}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entry
+}
+
+func activities(entries []Entry) []string {
+	ids := []string{}
+	for _, entry := range entries {
+		ids = append(ids, entry.ActivityID)
+	}
+	return ids
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestLoad(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+	o := open(t, path)
+	first := add(t, o, "a")
+	add(t, o, "b")
+	add(t, o, "c")
+	if _, err := o.Remove(first.ID); err != nil {
+		t.Fatal(err)
+	}
+	o.Close()
+
+	o = open(t, path)
+	defer o.Close()
+	got := activities(o.List())
+	if !equal(got, []string{"b", "c"}) {
+		t.Fatalf("got %v after reopening, want [b c]", got)
+	}
+	if next := add(t, o, "d"); next.ID != 4 {
+		t.Errorf("got id %d after reopening, want 4", next.ID)
+	}
+}
+
+func TestLoadTornTail(t *testing.T) {
+	tests := map[string]string{
+		"partial record":            `{"add":{"id":3,"operation":"del`,
+		"record without newline":    `{"add":{"id":3,"operation":"delete","vismaActivityId":"x"}}`,
+		"garbage after last record": "\x00\x00\x00",
+	}
+
+	for name, tail := range tests {
+		t.Run(name, func(t *testing.T) {
+			path, cleanup := tempPath(t)
+			defer cleanup()
+			o := open(t, path)
+			add(t, o, "a")
+			add(t, o, "b")
+			o.Close()
+
+			file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			file.WriteString(tail)
+			file.Close()
+
+			o = open(t, path)
+			add(t, o, "c")
+			add(t, o, "d")
+			o.Close()
+
+			o = open(t, path)
+			defer o.Close()
+			got := activities(o.List())
+			if !equal(got, []string{"a", "b", "c", "d"}) {
+				t.Fatalf("got %v after a torn tail, want [a b c d]", got)
+			}
+		})
+	}
+}
+
+func TestLoadCorruptRecord(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+	o := open(t, path)
+	add(t, o, "a")
+	o.Close()
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString("{\"add\":{\"id\":\x00\x00}}\n")
+	file.Close()
+
+	o = open(t, path)
+	add(t, o, "b")
+	add(t, o, "c")
+	o.Close()
+
+	o = open(t, path)
+	defer o.Close()
+	got := activities(o.List())
+	if !equal(got, []string{"a", "b", "c"}) {
+		t.Fatalf("got %v after a corrupt record, want [a b c]", got)
+	}
+}
+
+func TestHeads(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+	o := open(t, path)
+	defer o.Close()
+	a1 := add(t, o, "a")
+	add(t, o, "b")
+	a2 := add(t, o, "a")
+	add(t, o, "c")
+
+	tests := []struct {
+		name   string
+		change func() error
+		want   []string
+		ids    []uint64
+	}{
+		{"oldest per activity", func() error { return nil }, []string{"a", "b", "c"}, []uint64{a1.ID, 2, 4}},
+		{"failed stays head", func() error { return o.Failed(a1.ID, errors.New("unavailable")) },
+			[]string{"a", "b", "c"}, []uint64{a1.ID, 2, 4}},
+		{"dead letter lets the next through", func() error { return o.DeadLetter(a1.ID, errors.New("rejected")) },
+			[]string{"b", "a", "c"}, []uint64{2, a2.ID, 4}},
+	}
+
+	for _, test := range tests {
+		if err := test.change(); err != nil {
+			t.Fatal(err)
+		}
+		heads := o.Heads()
+		if got := activities(heads); !equal(got, test.want) {
+			t.Errorf("%s: got heads %v, want %v", test.name, got, test.want)
+			continue
+		}
+		for i, id := range test.ids {
+			if heads[i].ID != id {
+				t.Errorf("%s: got head %d with id %d, want %d", test.name, i, heads[i].ID, id)
+			}
+		}
+	}
+
+	if !o.Pending("a") {
+		t.Error("a has a queued entry behind the dead letter, but is not pending")
+	}
+	if o.Pending("x") {
+		t.Error("x has no entries, but is pending")
+	}
+	if got := len(o.List()); got != 4 {
+		t.Errorf("got %d entries, want 4 including the dead letter", got)
+	}
+}
+
+func TestFailedAfterRemove(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+	o := open(t, path)
+	defer o.Close()
+	entry := add(t, o, "a")
+	if _, err := o.Remove(entry.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := o.Failed(entry.ID, errors.New("unavailable")); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.DeadLetter(entry.ID, errors.New("rejected")); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(o.List()); got != 0 {
+		t.Errorf("got %d entries, want the removed entry to stay removed", got)
+	}
+
+	add(t, o, "b")
+	if err := o.Purge(); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Failed(entry.ID+1, errors.New("unavailable")); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(o.List()); got != 0 {
+		t.Errorf("got %d entries, want the purged entry to stay removed", got)
+	}
+}
@@ -0,0 +1,256 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tktip/flyvo-rpc-client/internal/secret"
+	"google.golang.org/grpc/credentials"
+)
+
+const (
+	// AuthAPIKey - send a static api key with every call
+	AuthAPIKey = "apiKey"
+	// AuthTokenFile - send a bearer token read from a file, re-read when it changes
+	AuthTokenFile = "tokenFile"
+	// AuthOAuth2 - send a bearer token fetched with the OAuth2 client credentials grant
+	AuthOAuth2 = "oauth2"
+
+	defaultAPIKeyHeader = "x-api-key"
+	defaultTokenHeader  = "authorization"
+
+	// tokens are refreshed this long before they expire, or halfway through
+	// their lifetime if that is sooner
+	tokenExpiryMargin = 30 * time.Second
+	// tokens without expires_in are used this long
+	defaultTokenLifetime = 5 * time.Minute
+)
+
+var (
+	// ErrorUnknownAuth - auth type is not one of the supported ones
+	ErrorUnknownAuth = errors.New("unknown auth type")
+	// ErrorNoToken - the token endpoint did not return a token
+	ErrorNoToken = errors.New("no access token in token response")
+)
+
+// Auth - credentials attached to every call to TIP, so TIP can tell tenants apart
+type Auth struct {
+	Type string `yaml:"type"`
+	// Header is the metadata key the credentials are sent in. Defaults to
+	// x-api-key for api keys, and authorization (as a bearer token) otherwise
+	Header    string        `yaml:"header"`
+	APIKey    secret.Secret `yaml:"apiKey"`
+	TokenFile string        `yaml:"tokenFile"`
+	OAuth2    OAuth2        `yaml:"oauth2"`
+	// AllowInsecure allows sending credentials on a connection without TLS
+	AllowInsecure bool `yaml:"allowInsecure"`
+}
+
+// OAuth2 - client credentials grant against a token endpoint
+type OAuth2 struct {
+	TokenURL     string        `yaml:"tokenUrl"`
+	ClientID     string        `yaml:"clientId"`
+	ClientSecret secret.Secret `yaml:"clientSecret"`
+	Scopes       []string      `yaml:"scopes"`
+}
+
+// Validate checks that the auth config has what its type needs
+func (a Auth) Validate() error {
+	_, err := a.credentials()
+	return err
+}
+
+// credentials returns the per-RPC credentials for the auth config, or nil if
+// no auth is configured
+func (a Auth) credentials() (credentials.PerRPCCredentials, error) {
+	var source tokenSource
+	header := defaultTokenHeader
+	prefix := "Bearer "
+
+	switch a.Type {
+	case "":
+		return nil, nil
+	case AuthAPIKey:
+		if a.APIKey == "" {
+			return nil, errors.New("auth type apiKey requires apiKey")
+		}
+		header = defaultAPIKeyHeader
+		prefix = ""
+		source = staticToken(a.APIKey.Value())
+	case AuthTokenFile:
+		if a.TokenFile == "" {
+			return nil, errors.New("auth type tokenFile requires tokenFile")
+		}
+		source = &fileToken{path: a.TokenFile}
+	case AuthOAuth2:
+		if a.OAuth2.TokenURL == "" || a.OAuth2.ClientID == "" {
+			return nil, errors.New("auth type oauth2 requires oauth2.tokenUrl and oauth2.clientId")
+		}
+		source = &oauth2Token{
+			config:     a.OAuth2,
+			httpClient: &http.Client{Timeout: 30 * time.Second},
+		}
+	default:
+		return nil, fmt.Errorf("%w: '%s'", ErrorUnknownAuth, a.Type)
+	}
+
+	if a.Header != "" {
+		header = a.Header
+	}
+	return &tokenCredentials{
+		header: strings.ToLower(header),
+		prefix: prefix,
+		source: source,
+		secure: !a.AllowInsecure,
+	}, nil
+}
+
+// tokenSource provides the current token to send to TIP
+type tokenSource interface {
+	token(ctx context.Context) (string, error)
+}
+
+// tokenCredentials implements credentials.PerRPCCredentials
+type tokenCredentials struct {
+	header string
+	prefix string
+	source tokenSource
+	secure bool
+}
+
+func (t *tokenCredentials) GetRequestMetadata(
+	ctx context.Context,
+	_ ...string,
+) (map[string]string, error) {
+	token, err := t.source.token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{t.header: t.prefix + token}, nil
+}
+
+func (t *tokenCredentials) RequireTransportSecurity() bool {
+	return t.secure
+}
+
+type staticToken string
+
+func (s staticToken) token(context.Context) (string, error) {
+	return string(s), nil
+}
+
+// fileToken reads the token from a file, re-reading it when the file changes
+type fileToken struct {
+	path     string
+	lock     sync.Mutex
+	value    string
+	modified time.Time
+}
+
+func (f *fileToken) token(context.Context) (string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return "", err
+	}
+	if f.value != "" && info.ModTime().Equal(f.modified) {
+		return f.value, nil
+	}
+
+	content, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return "", err
+	}
+	f.value = strings.TrimSpace(string(content))
+	f.modified = info.ModTime()
+	return f.value, nil
+}
+
+// oauth2Token fetches tokens from the token endpoint, and refreshes them
+// shortly before they expire
+type oauth2Token struct {
+	config     OAuth2
+	httpClient *http.Client
+	lock       sync.Mutex
+	value      string
+	expires    time.Time
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+func (o *oauth2Token) token(ctx context.Context) (string, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if o.value != "" && time.Now().Before(o.expires) {
+		return o.value, nil
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(o.config.Scopes) > 0 {
+		form.Set("scope", strings.Join(o.config.Scopes, " "))
+	}
+
+	req, err := http.NewRequest(http.MethodPost, o.config.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(o.config.ClientID), url.QueryEscape(o.config.ClientSecret.Value()))
+
+	resp, err := o.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint returned %d: %s", resp.StatusCode, body)
+	}
+
+	tr := tokenResponse{}
+	err = json.Unmarshal(body, &tr)
+	if err != nil {
+		return "", err
+	}
+	if tr.AccessToken == "" {
+		return "", ErrorNoToken
+	}
+
+	o.value = tr.AccessToken
+	o.expires = time.Now().Add(tokenLifetime(tr.ExpiresIn))
+	return o.value, nil
+}
+
+// tokenLifetime returns how long a token that expires in expiresIn seconds is
+// used before a new one is fetched
+func tokenLifetime(expiresIn int64) time.Duration {
+	lifetime := time.Duration(expiresIn) * time.Second
+	if lifetime <= 0 {
+		lifetime = defaultTokenLifetime
+	}
+	margin := tokenExpiryMargin
+	if margin > lifetime/2 {
+		margin = lifetime / 2
+	}
+	return lifetime - margin
+}
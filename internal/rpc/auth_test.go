@@ -0,0 +1,26 @@
+package rpc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenLifetime(t *testing.T) {
+	tests := []struct {
+		expiresIn int64
+		want      time.Duration
+	}{
+		{3600, time.Hour - tokenExpiryMargin},
+		{60, 30 * time.Second},
+		{30, 15 * time.Second},
+		{1, 500 * time.Millisecond},
+		{0, defaultTokenLifetime - tokenExpiryMargin},
+		{-5, defaultTokenLifetime - tokenExpiryMargin},
+	}
+
+	for _, test := range tests {
+		if got := tokenLifetime(test.expiresIn); got != test.want {
+			t.Errorf("expires_in %d: got %s, want %s", test.expiresIn, got, test.want)
+		}
+	}
+}
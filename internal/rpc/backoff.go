@@ -0,0 +1,132 @@
+package rpc
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	tipRPC "github.com/tktip/flyvo-api/pkg/rpc"
+	"github.com/tktip/flyvo-rpc-client/internal/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultBackoffInitial    = time.Second
+	defaultBackoffMax        = 2 * time.Minute
+	defaultBackoffMultiplier = 1.6
+	defaultBackoffJitter     = 0.2
+	defaultUnaryRetries      = 3
+
+	methodHandleGeneric = "/rpc.TipFlyvo/HandleGeneric"
+)
+
+// jitter is seeded per process, so clients restarted together spread out
+var (
+	jitter     = rand.New(rand.NewSource(time.Now().UnixNano()))
+	jitterLock sync.Mutex
+)
+
+// Backoff - how long to wait between attempts to reach TIP.
+// The n-th consecutive failure waits Initial * Multiplier^(n-1), capped at
+// Max, and randomly spread by +-Jitter (a fraction, e.g. 0.2 for 20%).
+type Backoff struct {
+	Initial      time.Duration `yaml:"initial"`
+	Max          time.Duration `yaml:"max"`
+	Multiplier   float64       `yaml:"multiplier"`
+	Jitter       *float64      `yaml:"jitter"`
+	UnaryRetries *int          `yaml:"unaryRetries"`
+}
+
+// setDefaults fills in unset values. initial is used as the initial delay if
+// none is set, for configs that predate backoff.
+func (b *Backoff) setDefaults(initial time.Duration) {
+	if b.Initial <= 0 {
+		b.Initial = initial
+	}
+	if b.Initial <= 0 {
+		b.Initial = defaultBackoffInitial
+	}
+	if b.Max < b.Initial {
+		b.Max = defaultBackoffMax
+		if b.Max < b.Initial {
+			b.Max = b.Initial
+		}
+	}
+	if b.Multiplier < 1 {
+		b.Multiplier = defaultBackoffMultiplier
+	}
+	if b.Jitter == nil || *b.Jitter < 0 || *b.Jitter > 1 {
+		jitter := defaultBackoffJitter
+		b.Jitter = &jitter
+	}
+	if b.UnaryRetries == nil {
+		retries := defaultUnaryRetries
+		b.UnaryRetries = &retries
+	}
+}
+
+// delay returns how long to wait after the given number of consecutive failures
+func (b Backoff) delay(failures int) time.Duration {
+	if failures < 1 {
+		failures = 1
+	}
+	d := float64(b.Initial) * math.Pow(b.Multiplier, float64(failures-1))
+	if d > float64(b.Max) {
+		d = float64(b.Max)
+	}
+
+	jitterLock.Lock()
+	d *= 1 + *b.Jitter*(jitter.Float64()*2-1)
+	jitterLock.Unlock()
+	return time.Duration(d)
+}
+
+// retryUnary retries idempotent unary calls to TIP with backoff while TIP is
+// unavailable
+func (c *Client) retryUnary(
+	ctx context.Context,
+	method string,
+	req, reply interface{},
+	cc *grpc.ClientConn,
+	invoker grpc.UnaryInvoker,
+	opts ...grpc.CallOption,
+) error {
+	backoff := c.current().backoff
+	for attempt := 1; ; attempt++ {
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		tipCalls.Inc(method, status.Code(err).String())
+		if err == nil {
+			contactedTIP()
+		}
+		if status.Code(err) != codes.Unavailable || attempt > *backoff.UnaryRetries ||
+			!idempotent(method, req) {
+			return err
+		}
+
+		wait := backoff.delay(attempt)
+		log.Logger.Warnf("%s failed (attempt %d), retrying in %s: %s", method, attempt, wait, err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// idempotent returns true for calls to TIP that can be sent again without
+// effect. TIP may have applied event changes and generic requests before it
+// became unavailable, so they are not retried, as that could apply them twice.
+func idempotent(method string, req interface{}) bool {
+	switch method {
+	case healthCheckMethod:
+		return true
+	case methodHandleGeneric:
+		generic, ok := req.(*tipRPC.Generic)
+		return ok && generic.Path == pathPing
+	}
+	return false
+}
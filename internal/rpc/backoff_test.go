@@ -0,0 +1,89 @@
+package rpc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	tipRPC "github.com/tktip/flyvo-api/pkg/rpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestBackoffJitter(t *testing.T) {
+	none, half, tooMuch := 0.0, 0.5, 2.0
+
+	tests := []struct {
+		name string
+		set  *float64
+		want float64
+	}{
+		{"unset", nil, defaultBackoffJitter},
+		{"off", &none, 0},
+		{"set", &half, 0.5},
+		{"out of range", &tooMuch, defaultBackoffJitter},
+	}
+
+	for _, test := range tests {
+		b := Backoff{Initial: time.Second, Jitter: test.set}
+		b.setDefaults(0)
+		if *b.Jitter != test.want {
+			t.Errorf("%s: got jitter %v, want %v", test.name, *b.Jitter, test.want)
+			continue
+		}
+
+		min := time.Duration(float64(time.Second) * (1 - test.want))
+		max := time.Duration(float64(time.Second) * (1 + test.want))
+		spread := false
+		for i := 0; i < 100; i++ {
+			d := b.delay(1)
+			if d < min || d > max {
+				t.Errorf("%s: got delay %s, want %s-%s", test.name, d, min, max)
+				break
+			}
+			spread = spread || d != time.Second
+		}
+		if spread != (test.want > 0) {
+			t.Errorf("%s: got delays spread %t, want %t", test.name, spread, test.want > 0)
+		}
+	}
+}
+
+func TestRetryUnary(t *testing.T) {
+	none, retries, timeout := 0.0, 2, time.Second
+	c := &Client{
+		ConnTimeout: &timeout,
+		Backoff:     Backoff{Initial: time.Millisecond, Jitter: &none, UnaryRetries: &retries},
+	}
+	c.Backoff.setDefaults(0)
+
+	tests := []struct {
+		method string
+		req    interface{}
+		want   int
+	}{
+		{healthCheckMethod, nil, 3},
+		{methodHandleGeneric, &tipRPC.Generic{Path: pathPing}, 3},
+		{methodHandleGeneric, &tipRPC.Generic{Path: tipRPC.PathRegisterAbsences}, 1},
+		{"/rpc.TipFlyvo/PublishEvent", &tipRPC.Event{}, 1},
+		{"/rpc.TipFlyvo/UpdateEvent", &tipRPC.Event{}, 1},
+		{"/rpc.TipFlyvo/DeleteEvent", &tipRPC.String{}, 1},
+		{"/rpc.TipFlyvo/RemoveFromEvent", &tipRPC.String{}, 1},
+	}
+
+	for _, test := range tests {
+		calls := 0
+		invoker := func(context.Context, string, interface{}, interface{}, *grpc.ClientConn, ...grpc.CallOption) error {
+			calls++
+			return status.Error(codes.Unavailable, "down")
+		}
+		err := c.retryUnary(context.Background(), test.method, test.req, nil, nil, invoker)
+		if status.Code(err) != codes.Unavailable {
+			t.Errorf("%s: got %v, want unavailable", test.method, err)
+		}
+		if calls != test.want {
+			t.Errorf("%s: got %d calls, want %d", test.method, calls, test.want)
+		}
+	}
+}
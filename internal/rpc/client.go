@@ -3,37 +3,50 @@ package rpc
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"io"
+	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/sirupsen/logrus"
 	tipRPC "github.com/tktip/flyvo-api/pkg/rpc"
 	"github.com/tktip/flyvo-rpc-client/internal/log"
+	"github.com/tktip/flyvo-rpc-client/internal/tlsconfig"
+	"github.com/tktip/flyvo-rpc-client/internal/tracing"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 )
 
-type Flyvo struct {
-	RootAddress string `yaml:"address"`
-}
-
 type Client struct {
-	RpcServerAddress  string `yaml:"serverAddress"`
-	RpcCertFile       string `yaml:"certFile"`
-	FlyvoApiEndpoints Flyvo  `yaml:"flyvo"`
+	RpcServerAddress  string          `yaml:"serverAddress"`
+	RpcCertFile       string          `yaml:"certFile"`
+	TLS               tlsconfig.Files `yaml:"tls"`
+	Auth              Auth            `yaml:"auth"`
+	FlyvoApiEndpoints Flyvo           `yaml:"flyvo"`
 
 	PollFrequency   time.Duration  `yaml:"pollFrequency"`
 	BadConnectSleep time.Duration  `yaml:"connFailSleep"`
+	Backoff         Backoff        `yaml:"backoff"`
 	ConnTimeout     *time.Duration `yaml:"connTimeout"`
-
-	ConnOK     bool
-	ctx        context.Context
-	grpcConn   *grpc.ClientConn
-	tipClient  tipRPC.TipFlyvoClient
-	done       bool
-	inFlightWg sync.WaitGroup
-	httpClient *http.Client
+	MaxInFlight     int            `yaml:"maxInFlight"`
+	StreamMode      string         `yaml:"streamMode"`
+	Keepalive       Keepalive      `yaml:"keepalive"`
+	HealthCheck     HealthCheck    `yaml:"healthCheck"`
+
+	state           connState
+	settingsLock    sync.RWMutex
+	ctx             context.Context
+	grpcConn        *grpc.ClientConn
+	tipClient       tipRPC.TipFlyvoClient
+	done            int32
+	noHealthService int32
+	inFlightWg      sync.WaitGroup
+	httpClient      *http.Client
+	httpOnce        sync.Once
+	slots           chan struct{}
 }
 
 func (c *Client) Run(ctx context.Context) {
@@ -43,29 +56,80 @@ func (c *Client) Run(ctx context.Context) {
 	}
 
 	if c.ConnTimeout == nil {
-		log.Logger.Warn("No timeout provided, defaulting to 15s")
-		t := time.Second * 15
+		log.Logger.Warnf("No timeout provided, defaulting to %s", defaultConnTimeout)
+		t := defaultConnTimeout
 		c.ConnTimeout = &t
 	}
 
+	switch c.StreamMode {
+	case StreamModePersistent, StreamModePoll:
+	case "":
+		c.StreamMode = StreamModePoll
+	default:
+		log.Logger.Warnf("Unknown stream mode '%s', defaulting to '%s'",
+			c.StreamMode, StreamModePoll)
+		c.StreamMode = StreamModePoll
+	}
+
+	for _, legacy := range c.FlyvoApiEndpoints.LegacyPaths() {
+		log.Logger.Warnf("api.rpc.flyvo.%s is deprecated, use api.rpc.flyvo.routes.%s.path instead",
+			legacy.Setting, legacy.TipPath)
+	}
+
+	c.Backoff.setDefaults(c.BadConnectSleep)
+
+	if c.MaxInFlight < 1 {
+		c.MaxInFlight = defaultMaxInFlight
+		log.Logger.Warnf("No max in flight provided, defaulting to %d", defaultMaxInFlight)
+	}
+	c.slots = make(chan struct{}, c.MaxInFlight)
+
 	var err error
 	opts := []grpc.DialOption{}
-	if c.RpcCertFile != "" {
-		var creds credentials.TransportCredentials
+	tlsFiles := c.TLS
+	if tlsFiles.CAFile == "" {
+		tlsFiles.CAFile = c.RpcCertFile
+	}
+	if !tlsFiles.Empty() {
+		var certs *tlsconfig.Reloader
 
-		// Create the client TLS credentials
-		creds, err = credentials.NewClientTLSFromFile(c.RpcCertFile, "")
+		// Create the client TLS credentials, reloaded when the files change
+		certs, err = tlsconfig.NewReloader(tlsFiles)
 		if err != nil {
 			log.Logger.Fatalf("could not load tls cert: %s", err)
 		}
+		go certs.Watch(ctx)
+
+		serverName, _, err := net.SplitHostPort(c.RpcServerAddress)
+		if err != nil {
+			serverName = c.RpcServerAddress
+		}
+		creds := credentials.NewTLS(certs.ClientConfig(serverName))
 		opts = append(opts, grpc.WithTransportCredentials(creds))
 		log.Logger.Infof("TLS certificate registered")
+		if tlsFiles.CertFile != "" {
+			log.Logger.Infof("Authenticating with client certificate %s", tlsFiles.CertFile)
+		}
 	} else {
 
 		log.Logger.Infof("Running without TLS (insecure)")
 		opts = append(opts, grpc.WithInsecure())
 	}
 
+	perRPC, err := c.Auth.credentials()
+	if err != nil {
+		log.Logger.Fatalf("could not set up auth: %s", err)
+	}
+	if perRPC != nil {
+		opts = append(opts, grpc.WithPerRPCCredentials(perRPC))
+		log.Logger.Infof("Authenticating calls to TIP with %s", c.Auth.Type)
+	}
+
+	opts = append(opts,
+		grpc.WithKeepaliveParams(c.Keepalive.params()),
+		grpc.WithChainUnaryInterceptor(c.traceUnary, c.retryUnary),
+	)
+
 	// Set up a tipClient to the server.
 	c.grpcConn, err = grpc.Dial(c.RpcServerAddress, opts...)
 	if err != nil {
@@ -73,113 +137,305 @@ func (c *Client) Run(ctx context.Context) {
 	}
 	c.tipClient = tipRPC.NewTipFlyvoClient(c.grpcConn)
 	c.ctx = ctx
+	c.inFlightWg.Add(1)
+	go c.watchHealth()
 	c.pollServerForGenericRequests()
 }
 
-//Contacts TIP every 5 seconds and asks TIP to create an event.
-//stalls
+//pollServerForGenericRequests keeps a ProcessRequests stream to TIP, through
+//which TIP sends requests for FLYVO. Stalls until the client context is done,
+//and the requests in flight have been answered.
 func (c *Client) pollServerForGenericRequests() {
+	c.inFlightWg.Add(1)
 	go func() {
-		c.inFlightWg.Add(1)
+		for !c.shuttingDown() {
+			if c.StreamMode == StreamModePoll {
+				c.pollOnce()
+			} else {
+				c.streamOnce()
+			}
+		}
+		log.Logger.Debug("I'm done")
+		c.inFlightWg.Done()
+	}()
+	<-c.ctx.Done()
+	atomic.StoreInt32(&c.done, 1)
+	log.Logger.Info("Shutting down, waiting for requests in flight")
+	//Requests in flight still need the connection to respond
+	c.inFlightWg.Wait()
+	c.grpcConn.Close()
+	log.Logger.Info("Connection to TIP closed")
+}
 
-		for !c.done {
-			ctx, cancel := context.WithTimeout(context.Background(), *c.ConnTimeout)
+//pollOnce contacts TIP and handles the requests TIP has waiting, then sleeps
+//for PollFrequency.
+func (c *Client) pollOnce() {
+	settings := c.current()
+	ctx, cancel := context.WithTimeout(context.Background(), settings.connTimeout)
+	//cancel lingering context since we're done pre-timeout
+	defer cancel()
 
-			//This runs the function ProcessRequests in flyvo-api.
-			//It returns a stream object through which requests are sent and received.
+	//This runs the function ProcessRequests in flyvo-api.
+	//It returns a stream object through which requests are sent and received.
+	log.Logger.Debugf("Trying to connect to TIP (timeout %s)", settings.connTimeout)
+	pollConnection, err := c.tipClient.ProcessRequests(ctx)
 
-			log.Logger.Debugf("Trying to connect to TIP (timeout %s)", *c.ConnTimeout)
-			pollConnection, err := c.tipClient.ProcessRequests(ctx)
+	//If the connection attempt failed, no point in doing anything.
+	if err != nil {
+		c.connectFailed(err)
+		return
+	}
+	streamOpens.Inc(StreamModePoll)
+	c.connected()
 
-			//If the connection attempt failed, no point in doing anything.
-			if err != nil {
-				c.ConnOK = false
-				log.Logger.Errorf("Failed to connect to TIP: %v", err)
-				log.Logger.Debugf("Sleeping for %s", c.BadConnectSleep)
-				time.Sleep(c.BadConnectSleep)
-				cancel()
-				continue
+	//While the stream is open, grab incoming data
+	err = c.processStream(pollConnection)
+	if err != nil {
+		log.Logger.Errorf("Failed to receive generic request from TIP: %s", err.Error())
+	}
+
+	//Send EOF to flyvo-api, indicating that we're done.
+	err = pollConnection.CloseSend()
+	if err != nil {
+		log.Logger.Errorf("Error during close send: %s", err.Error())
+	}
+
+	log.Logger.Debug("Done looking for requests")
+	log.Logger.Debugf("Sleeping for %s", settings.pollFrequency)
+	select {
+	case <-time.After(settings.pollFrequency):
+	case <-c.ctx.Done():
+	}
+}
+
+//streamOnce opens a long-lived stream to TIP and handles requests on it until
+//it breaks down. The connection is kept alive by gRPC keepalive pings.
+func (c *Client) streamOnce() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	log.Logger.Debug("Opening request stream to TIP")
+	opened := time.Now()
+	stream, err := c.tipClient.ProcessRequests(ctx)
+	if err != nil {
+		c.connectFailed(err)
+		return
+	}
+	streamOpens.Inc(StreamModePersistent)
+	c.connected()
+
+	err = c.processStream(stream)
+	if err != nil {
+		c.connectFailed(err)
+		return
+	}
+	if c.ctx.Err() != nil {
+		stream.CloseSend()
+		return
+	}
+
+	//TIP closed the stream on its end. Open a new one, but no more often than
+	//the initial backoff, in case TIP closes every stream once it is drained.
+	err = stream.CloseSend()
+	if err != nil {
+		log.Logger.Errorf("Error during close send: %s", err.Error())
+	}
+	wait := c.current().backoff.delay(1) - time.Since(opened)
+	if wait <= 0 {
+		log.Logger.Info("Request stream closed by TIP, reopening")
+		return
+	}
+	log.Logger.Infof("Request stream closed by TIP, reopening in %s", wait)
+	select {
+	case <-time.After(wait):
+	case <-c.ctx.Done():
+	}
+}
+
+func (c *Client) shuttingDown() bool {
+	return atomic.LoadInt32(&c.done) == 1
+}
+
+//Status returns the current state of the connection to TIP
+func (c *Client) Status() ConnStatus {
+	return c.state.status()
+}
+
+//PingTIP returns nil if the request stream to TIP is connected and the last
+//health check (if any) succeeded, and the last error otherwise
+func (c *Client) PingTIP(ctx context.Context) error {
+	status := c.Status()
+	if !status.Connected && status.LastError != "" {
+		return errors.New(status.LastError)
+	}
+	if !status.Connected {
+		return errors.New("not connected")
+	}
+	if status.Healthy != nil && !*status.Healthy {
+		return errors.New(status.HealthError)
+	}
+	return nil
+}
+
+func (c *Client) connected() {
+	contactedTIP()
+	if c.state.succeeded() {
+		//TIP may have been upgraded while away
+		atomic.StoreInt32(&c.noHealthService, 0)
+		streamReconnects.Inc()
+		log.Logger.Info("Successfully connected to TIP again.")
+	}
+}
+
+//connectFailed records the failure and backs off before the next attempt
+func (c *Client) connectFailed(err error) {
+	streamFailures.Inc()
+	failures, wait := c.state.failed(err, c.current().backoff)
+	log.Logger.Errorf("Failed to connect to TIP (%d in a row): %v", failures, err)
+	log.Logger.Debugf("Sleeping for %s", wait)
+	select {
+	case <-time.After(wait):
+	case <-c.ctx.Done():
+	}
+}
+
+//processStream receives requests until the stream is closed or the client is
+//shutting down, handling up to MaxInFlight of them at a time. Returns once
+//every response has been sent, with an error if the stream was not closed by TIP.
+func (c *Client) processStream(stream tipRPC.TipFlyvo_ProcessRequestsClient) error {
+	var (
+		sendLock sync.Mutex
+		handling sync.WaitGroup
+	)
+
+	requests, failed, stop := c.receive(stream, &sendLock)
+	defer close(stop)
+
+	for {
+		log.Logger.Debug("Retrieving")
+		var request *tipRPC.Generic
+		select {
+		case request = <-requests:
+		case err := <-failed:
+			handling.Wait()
+			//io.EOF means that the connection was closed at the other end (flyvo-api).
+			if err == io.EOF {
+				log.Logger.Debug("poll EOF")
+				return nil
 			}
+			return err
+		case <-c.ctx.Done():
+			//Stop taking requests, but answer the ones being handled
+			handling.Wait()
+			return nil
+		}
 
-			if !c.ConnOK {
-				c.ConnOK = true
-				log.Logger.Info("Successfully connected to TIP again.")
+		contactedTIP()
+		ctx := log.WithFields(c.ctx, logrus.Fields{"msgID": request.MsgID, "path": request.Path})
+		log.FromContext(ctx).Debugf("Received this: headers[%v], body[%s]",
+			request.Headers,
+			request.Body,
+		)
+
+		//Wait for a free slot before handling the request, refusing it if the
+		//client shuts down meanwhile
+		select {
+		case c.slots <- struct{}{}:
+		case <-c.ctx.Done():
+			log.FromContext(ctx).Warn("Refusing request, shutting down")
+			sendLock.Lock()
+			stream.Send(&tipRPC.Generic{
+				MsgID:  request.MsgID,
+				Body:   []byte(ErrorShuttingDown.Error()),
+				Status: http.StatusServiceUnavailable,
+			})
+			sendLock.Unlock()
+			handling.Wait()
+			return nil
+		}
+		handling.Add(1)
+		tipRequestsInFlight.Add(1)
+		go func(ctx context.Context, request *tipRPC.Generic) {
+			defer func() {
+				tipRequestsInFlight.Add(-1)
+				<-c.slots
+				handling.Done()
+			}()
+
+			//Do some processing of the received request
+			response, err := c.handleGenericRequest(ctx, *request)
+			if err != nil {
+				log.FromContext(ctx).Errorf("Failed to process request: %s", err.Error())
 			}
 
-			//While the stream is open, grab incoming data
-			for {
-				log.Logger.Debug("Retrieving")
-				request, err := pollConnection.Recv()
-
-				//io.EOF means that the connection was closed at the other end (flyvo-api).
-				if err == io.EOF {
-					log.Logger.Debug("poll EOF")
-					break
-				} else if err != nil {
-					log.Logger.Errorf("Failed to receive generic request from TIP: %s", err.Error())
-					break
-				}
-
-				log.Logger.Debugf("Received this: path[%v], headers[%v], body[%s]",
-					request.Path,
-					request.Headers,
-					request.Body,
-				)
-
-				//Do some processing of the received request
-				response, err := c.handleGenericRequest(*request)
-				if err != nil {
-					log.Logger.Errorf("Failed to process request with msgID %s: %s", request.MsgID, err.Error())
-				}
-
-				//Then respond to flyvo-api with the result of processing.
-				err = pollConnection.Send(&response)
-				if err != nil {
-					log.Logger.Errorf("Failed to respond to request with msgID %s: %s", request.MsgID, err.Error())
-				}
+			//Then respond to flyvo-api with the result of processing.
+			//Responses are matched to requests by msgID, so order does not matter.
+			sendLock.Lock()
+			err = stream.Send(&response)
+			sendLock.Unlock()
+			if err != nil {
+				log.FromContext(ctx).Errorf("Failed to respond to request: %s", err.Error())
 			}
+		}(ctx, request)
+	}
+}
 
-			//Send EOF to flyvo-api, indicating that we're done.
-			err = pollConnection.CloseSend()
+//receive reads requests from the stream in the background, so reading can be
+//abandoned on shutdown. Requests received after stop is closed are refused.
+func (c *Client) receive(
+	stream tipRPC.TipFlyvo_ProcessRequestsClient, sendLock *sync.Mutex,
+) (<-chan *tipRPC.Generic, <-chan error, chan struct{}) {
+	requests := make(chan *tipRPC.Generic)
+	failed := make(chan error, 1)
+	stop := make(chan struct{})
+
+	go func() {
+		for {
+			request, err := stream.Recv()
 			if err != nil {
-				log.Logger.Errorf("Error during close send: %s", err.Error())
+				failed <- err
+				return
 			}
 
-			//cancel lingering context since we're done pre-timeout
-			cancel()
-			log.Logger.Debug("Done looking for requests")
-			log.Logger.Debugf("Sleeping for %s", c.PollFrequency)
-			time.Sleep(c.PollFrequency)
+			select {
+			case requests <- request:
+				continue
+			case <-stop:
+			}
+
+			log.Logger.WithField("msgID", request.MsgID).Warn("Refusing request, shutting down")
+			sendLock.Lock()
+			stream.Send(&tipRPC.Generic{
+				MsgID:  request.MsgID,
+				Body:   []byte(ErrorShuttingDown.Error()),
+				Status: http.StatusServiceUnavailable,
+			})
+			sendLock.Unlock()
 		}
-		log.Logger.Debug("I'm done")
-		c.inFlightWg.Done()
 	}()
-	select {
-	case <-c.ctx.Done():
-		c.done = true
-		c.grpcConn.Close()
-		c.inFlightWg.Wait()
-	}
-}
-
-func (c *Client) handleGenericRequest(request tipRPC.Generic) (response tipRPC.Generic, err error) {
-	req, _ := json.Marshal(request)
-	log.Logger.Debugf("Generic request: %s", req)
-	switch request.Path {
-	case tipRPC.PathGetAbsences:
-		response, err = c.handleGetAbsenceForPeriod(request)
-	case tipRPC.PathRegisterAbsences:
-		response, err = c.handlePushUnauthorizedAbsence(request)
-	case tipRPC.PathRegisterSickLeave:
-		response, err = c.handleRegisterSickLeave(request)
-	case tipRPC.PathGetSickLeaves:
-		response, err = c.handleGetSickLeavesLastYear(request)
-	case tipRPC.PathGetTeacherCourses:
-		response, err = c.handleGetTodaysCoursesForTeacher(request)
-	case tipRPC.PathAbsenceToSickLeave:
-		response, err = c.handleAbsenceToSickLeave(request)
-	default:
-		log.Logger.Debugf("Unknown path '%s'", request.Path)
+	return requests, failed, stop
+}
+
+//handleGenericRequest handles a request from TIP, continuing the trace given
+//in its headers. The response carries the trace context back to TIP.
+func (c *Client) handleGenericRequest(ctx context.Context, request tipRPC.Generic) (response tipRPC.Generic, err error) {
+	ctx = tracing.Extract(ctx, request.Headers[tracing.TraceparentHeader])
+	ctx, span := tracing.Start(ctx, "tip "+request.Path, tracing.KindServer)
+	defer span.End()
+	span.SetAttribute("tip.path", request.Path)
+	span.SetAttribute("tip.msg_id", request.MsgID)
+
+	start := time.Now()
+	logger := log.FromContext(ctx)
+	logger.Debugf("Generic request: headers[%v], body[%s]", request.Headers, request.Body)
+	flyvo := c.current().flyvo
+	route, ok := flyvo.route(request.Path)
+	if ok {
+		tipRequests.Inc(request.Path)
+		response, err = c.handleRoute(ctx, flyvo, route, request)
+	} else {
+		tipRequests.Inc("unknown")
+		logger.Debug("Unknown path")
 		response = tipRPC.Generic{
 			Body:   []byte("unknown path"),
 			Status: http.StatusBadRequest,
@@ -188,21 +444,29 @@ func (c *Client) handleGenericRequest(request tipRPC.Generic) (response tipRPC.G
 	}
 
 	response.MsgID = request.MsgID
-	resp, _ := json.Marshal(response)
-	log.Logger.Debugf("Response from FLYVO: %s", resp)
+	response.Headers = tracing.Inject(ctx, response.Headers)
+	span.SetAttribute("tip.status", int(response.Status))
+	span.SetError(err)
+	logger.Debugf("Response from FLYVO: status[%d], body[%s]", response.Status, response.Body)
+	logger.WithFields(logrus.Fields{
+		"flyvoStatus": response.Status,
+		"duration":    time.Since(start).Seconds(),
+	}).Info("Handled request from TIP")
 	return response, err
 }
 
 //SendGeneric - send a generic request
 func (c *Client) SendGeneric(ctx context.Context, message tipRPC.Generic) (*tipRPC.Generic, error) {
 	log.Logger.Debug("Sending generic message")
-	if c.done {
+	if c.shuttingDown() {
 		return nil, ErrorShuttingDown
 	}
 	c.inFlightWg.Add(1)
 	defer c.inFlightWg.Done()
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	tracing.FromContext(ctx).SetAttribute("tip.msg_id", message.MsgID)
+	message.Headers = tracing.Inject(ctx, message.Headers)
+	ctx, cancel := context.WithTimeout(tracing.Detach(ctx), 5*time.Second)
 	defer cancel()
 
 	return c.tipClient.HandleGeneric(ctx, &message)
@@ -220,6 +484,33 @@ func (c *Client) DeleteEvent(ctx context.Context, eventId string) (*tipRPC.Gener
 
 	return c.tipClient.DeleteEvent(ctx, &tipRPC.String{Value: eventId})
 }
+
+//RemoveFromEventRequest - which participant to remove from which event.
+//RemoveFromEvent only takes a String, so both ids are sent as the json
+//{"vismaActivityId": "...", "vismaId": "..."} in its value, and both are
+//required. The format is proposed, not yet agreed with TIP or in the proto.
+type RemoveFromEventRequest struct {
+	VismaActivityID string `json:"vismaActivityId"`
+	VismaID         string `json:"vismaId"`
+}
+
+//RemoveFromEvent - remove a single participant from an event
+func (c *Client) RemoveFromEvent(ctx context.Context, eventId, vismaId string) (*tipRPC.Generic, error) {
+	log.Logger.WithField("vismaId", vismaId).Debugf("REMOVE RPC: from %s", eventId)
+	if eventId == "" || vismaId == "" {
+		return nil, errors.New("remove from event requires vismaActivityId and vismaId")
+	}
+
+	value, err := json.Marshal(RemoveFromEventRequest{
+		VismaActivityID: eventId,
+		VismaID:         vismaId,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c.tipClient.RemoveFromEvent(ctx, &tipRPC.String{Value: string(value)})
+}
+
 func (c *Client) PostEvent(ctx context.Context, message *tipRPC.Event) (*tipRPC.Generic, error) {
 
 	eventjson, _ := json.Marshal(message)
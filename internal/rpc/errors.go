@@ -4,5 +4,6 @@ import "errors"
 
 var (
 	ErrorShuttingDown = errors.New("shutting down")
-	ErrorBadPath  = errors.New("unknown path provided")
-)
\ No newline at end of file
+	ErrorBadPath      = errors.New("unknown path provided")
+	ErrorMissingParam = errors.New("missing path parameter in request body")
+)
@@ -1,44 +1,67 @@
 package rpc
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"time"
 
-	model "github.com/tktip/flyvo-api/pkg/flyvo"
+	"github.com/sirupsen/logrus"
 	tipRPC "github.com/tktip/flyvo-api/pkg/rpc"
 	"github.com/tktip/flyvo-rpc-client/internal/log"
+	"github.com/tktip/flyvo-rpc-client/internal/tracing"
 )
 
 const cTypeJson = "application/json"
 
 const (
-	defaultAddress                  = "localhost:50051"
-	convertAbsenceToSickLeave       = "/absence"
-	getCoursesEndpoint              = "/getoverview/"
-	registerUnauthorizedAbsence     = "/absence"
-	getUnauthorizedAbsencesEndpoint = "/getinvalidabsenceforperson"
-	registerSickLeave               = "/selfcertification"
-	getSickLeaves                   = "/getselfcertificationoverview"
+	defaultAddress     = "localhost:50051"
+	defaultMaxInFlight = 10
 )
 
-func (c *Client) doHTTPToFlyVo(method string, url string, body io.Reader) ([]byte, int, error) {
-	if c.httpClient == nil {
-		c.httpClient = &http.Client{
-			Timeout: time.Second * 30,
+// doHTTPToFlyVo sends a request to FLYVO. Only the route template is logged,
+// as the url may hold personal data such as visma ids. The request is
+// cancelled with ctx, e.g. on shutdown.
+func (c *Client) doHTTPToFlyVo(
+	ctx context.Context, path, method, template, url string, body io.Reader,
+) (_ []byte, status int, err error) {
+	ctx, span := tracing.Start(ctx, "FLYVO "+method, tracing.KindClient)
+	span.SetAttribute("http.method", method)
+	span.SetAttribute("http.route", template)
+	span.SetAttribute("tip.path", path)
+
+	start := time.Now()
+	defer func() {
+		if status > 0 {
+			span.SetAttribute("http.status_code", status)
 		}
-	}
+		span.SetError(err)
+		span.End()
+		log.FromContext(ctx).WithFields(logrus.Fields{
+			"flyvoStatus": status,
+			"duration":    time.Since(start).Seconds(),
+		}).Debugf("%s %s done", method, template)
+		flyvoDuration.Observe(time.Since(start).Seconds(), path)
+		if status > 0 {
+			flyvoRequests.Inc(path, strconv.Itoa(status))
+		} else {
+			flyvoRequests.Inc(path, "error")
+		}
+	}()
 
-	log.Logger.Debugf("Sending request to '%s'", url)
-	req, err := http.NewRequest(method, url, body)
+	log.FromContext(ctx).Debugf("Sending request to '%s'", template)
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
 	if err != nil {
 		return nil, -1, err
 	}
+	if traceparent := tracing.Traceparent(ctx); traceparent != "" {
+		req.Header.Set(tracing.TraceparentHeader, traceparent)
+	}
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.client().Do(req)
 	if err != nil {
 		return nil, -1, err
 	}
@@ -51,39 +74,30 @@ func (c *Client) doHTTPToFlyVo(method string, url string, body io.Reader) ([]byt
 	return bod, resp.StatusCode, err
 }
 
-func (c *Client) handlePushUnauthorizedAbsence(request tipRPC.Generic) (response tipRPC.Generic, err error) {
-	url := c.FlyvoApiEndpoints.RootAddress + registerUnauthorizedAbsence
-	cont, status, err := c.doHTTPToFlyVo(http.MethodPost, url, bytes.NewReader(request.Body))
+// PingFlyvo checks that the FLYVO root address answers. Any response short of a
+// server error counts, as the root itself need not be a valid endpoint.
+func (c *Client) PingFlyvo(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.current().flyvo.RootAddress, nil)
 	if err != nil {
-		return tipRPC.Generic{Body: []byte(err.Error()), Status: http.StatusInternalServerError}, err
+		return err
 	}
 
-	return tipRPC.Generic{
-		Headers: map[string]string{"path": request.Path},
-		MsgID:   request.MsgID,
-		Status:  int32(status),
-		Body:    cont,
-	}, nil
-}
-
-func (c *Client) handleGetAbsenceForPeriod(request tipRPC.Generic) (response tipRPC.Generic, err error) {
-	url := c.FlyvoApiEndpoints.RootAddress + getUnauthorizedAbsencesEndpoint
-	cont, status, err := c.doHTTPToFlyVo(http.MethodGet, url, bytes.NewReader(request.Body))
+	resp, err := c.client().Do(req)
 	if err != nil {
-		return tipRPC.Generic{Body: []byte(err.Error()), Status: http.StatusInternalServerError}, err
+		return err
 	}
-
-	return tipRPC.Generic{
-		Headers: map[string]string{"path": request.Path},
-		MsgID:   request.MsgID,
-		Status:  int32(status),
-		Body:    cont,
-	}, nil
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("FLYVO answered %s", resp.Status)
+	}
+	return nil
 }
 
-func (c *Client) handleGetSickLeavesLastYear(request tipRPC.Generic) (response tipRPC.Generic, err error) {
-	gsl := model.GetSickLeavesRequest{}
-	err = json.Unmarshal(request.Body, &gsl)
+// handleRoute forwards a request from TIP to FLYVO as described by the route
+func (c *Client) handleRoute(
+	ctx context.Context, flyvo Flyvo, route Route, request tipRPC.Generic,
+) (response tipRPC.Generic, err error) {
+	url, err := flyvo.url(route, request)
 	if err != nil {
 		return tipRPC.Generic{
 			Body:   []byte(err.Error()),
@@ -91,13 +105,14 @@ func (c *Client) handleGetSickLeavesLastYear(request tipRPC.Generic) (response t
 		}, err
 	}
 
-	url := c.FlyvoApiEndpoints.RootAddress + getSickLeaves + "/" + gsl.VismaID + "/" + gsl.ToDate
-	cont, status, err := c.doHTTPToFlyVo(http.MethodGet, url, nil)
+	cont, status, err := c.doHTTPToFlyVo(ctx, request.Path, route.Method,
+		flyvo.RootAddress+route.Path, url, route.body(request))
 	if err != nil {
 		return tipRPC.Generic{Body: []byte(err.Error()), Status: http.StatusInternalServerError}, err
 	}
 
 	return tipRPC.Generic{
+		Path:    request.Path,
 		Headers: map[string]string{"path": request.Path},
 		MsgID:   request.MsgID,
 		Status:  int32(status),
@@ -105,60 +120,13 @@ func (c *Client) handleGetSickLeavesLastYear(request tipRPC.Generic) (response t
 	}, nil
 }
 
-func (c *Client) handleRegisterSickLeave(request tipRPC.Generic) (response tipRPC.Generic, err error) {
-	url := c.FlyvoApiEndpoints.RootAddress + registerSickLeave
-	cont, status, err := c.doHTTPToFlyVo(http.MethodPost, url, bytes.NewReader(request.Body))
-	if err != nil {
-		return tipRPC.Generic{Body: []byte(err.Error()), Status: http.StatusInternalServerError}, err
-	}
-
-	return tipRPC.Generic{
-		Headers: map[string]string{"path": request.Path},
-		MsgID:   request.MsgID,
-		Status:  int32(status),
-		Body:    cont,
-	}, nil
-}
-
-func (c *Client) handleGetTodaysCoursesForTeacher(request tipRPC.Generic) (response tipRPC.Generic, err error) {
-	gcr := model.GetCoursesRequest{}
-	err = json.Unmarshal(request.Body, &gcr)
-	if err != nil {
-		return tipRPC.Generic{
-			Body:   []byte(err.Error()),
-			Status: http.StatusUnprocessableEntity,
-		}, err
-	}
-
-	from := gcr.FromDate.Format("02012006")
-	to := gcr.ToDate.Format("02012006")
-
-	url := c.FlyvoApiEndpoints.RootAddress + getCoursesEndpoint + from + "/" + to
-	cont, status, err := c.doHTTPToFlyVo(http.MethodGet, url, nil)
-
-	if err != nil {
-		return tipRPC.Generic{Body: []byte(err.Error()), Status: http.StatusInternalServerError}, err
-	}
-
-	return tipRPC.Generic{
-		Path:   request.Path,
-		MsgID:  request.MsgID,
-		Status: int32(status),
-		Body:   cont,
-	}, nil
-}
-
-func (c *Client) handleAbsenceToSickLeave(request tipRPC.Generic) (response tipRPC.Generic, err error) {
-	url := c.FlyvoApiEndpoints.RootAddress + convertAbsenceToSickLeave
-	cont, status, err := c.doHTTPToFlyVo(http.MethodPost, url, bytes.NewReader(request.Body))
-	if err != nil {
-		return tipRPC.Generic{Body: []byte(err.Error()), Status: http.StatusInternalServerError}, err
-	}
-
-	return tipRPC.Generic{
-		Headers: map[string]string{"path": request.Path},
-		MsgID:   request.MsgID,
-		Status:  int32(status),
-		Body:    cont,
-	}, nil
+func (c *Client) client() *http.Client {
+	c.httpOnce.Do(func() {
+		if c.httpClient == nil {
+			c.httpClient = &http.Client{
+				Timeout: time.Second * 30,
+			}
+		}
+	})
+	return c.httpClient
 }
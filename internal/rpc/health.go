@@ -0,0 +1,141 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	tipRPC "github.com/tktip/flyvo-api/pkg/rpc"
+	"github.com/tktip/flyvo-rpc-client/internal/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// HealthCheckGRPC - TIP is checked with the grpc.health.v1 protocol
+	HealthCheckGRPC = "grpc.health.v1"
+	// HealthCheckPing - TIP does not implement grpc.health.v1, so it is checked
+	// by sending the generic path "ping"
+	HealthCheckPing = "ping"
+
+	healthCheckMethod = "/grpc.health.v1.Health/Check"
+	pathPing          = "ping"
+
+	defaultHealthInterval = 30 * time.Second
+	defaultHealthTimeout  = 5 * time.Second
+)
+
+// HealthCheck - how often TIP is health checked in the background
+type HealthCheck struct {
+	// Interval between checks (default 30s), negative to only check on demand
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+	// Service is the service name sent to grpc.health.v1, empty for the whole server
+	Service string `yaml:"service"`
+}
+
+func (h HealthCheck) interval() time.Duration {
+	if h.Interval == 0 {
+		return defaultHealthInterval
+	}
+	return h.Interval
+}
+
+func (h HealthCheck) timeout() time.Duration {
+	if h.Timeout <= 0 {
+		return defaultHealthTimeout
+	}
+	return h.Timeout
+}
+
+// CheckHealth checks that TIP is serving, with grpc.health.v1 if TIP implements
+// it and the ping path otherwise. Returns TIP's answer.
+func (c *Client) CheckHealth(ctx context.Context) (string, error) {
+	if c.shuttingDown() {
+		return "", ErrorShuttingDown
+	}
+	c.inFlightWg.Add(1)
+	defer c.inFlightWg.Done()
+
+	ctx, cancel := context.WithTimeout(ctx, c.HealthCheck.timeout())
+	defer cancel()
+
+	method := HealthCheckGRPC
+	answer, err := c.checkGRPCHealth(ctx)
+	if status.Code(err) == codes.Unimplemented {
+		if atomic.CompareAndSwapInt32(&c.noHealthService, 0, 1) {
+			log.Logger.Info("TIP does not implement grpc.health.v1, health checking with the ping path")
+		}
+		method = HealthCheckPing
+		answer, err = c.ping(ctx)
+	}
+
+	result := "serving"
+	if err != nil {
+		result = "error"
+	}
+	tipHealthChecks.Inc(method, result)
+	c.state.checked(method, err)
+	if err == nil {
+		tipHealthy.Set(1)
+		contactedTIP()
+	} else {
+		tipHealthy.Set(0)
+	}
+	return answer, err
+}
+
+// checkGRPCHealth calls grpc.health.v1.Health/Check, unless TIP is known not
+// to implement it
+func (c *Client) checkGRPCHealth(ctx context.Context) (string, error) {
+	if atomic.LoadInt32(&c.noHealthService) == 1 {
+		return "", status.Error(codes.Unimplemented, "grpc.health.v1 not implemented by TIP")
+	}
+
+	response, err := grpc_health_v1.NewHealthClient(c.grpcConn).Check(ctx,
+		&grpc_health_v1.HealthCheckRequest{Service: c.HealthCheck.Service})
+	if err != nil {
+		return "", err
+	}
+
+	answer := response.Status.String()
+	if response.Status != grpc_health_v1.HealthCheckResponse_SERVING {
+		return answer, fmt.Errorf("TIP is %s", answer)
+	}
+	return answer, nil
+}
+
+// ping sends the generic path "ping", the convention TIP used before health checks
+func (c *Client) ping(ctx context.Context) (string, error) {
+	response, err := c.tipClient.HandleGeneric(ctx, &tipRPC.Generic{Path: pathPing})
+	if err != nil {
+		return "", err
+	}
+	return string(response.Body), nil
+}
+
+// watchHealth checks TIP every HealthCheck interval until the client shuts down
+func (c *Client) watchHealth() {
+	defer c.inFlightWg.Done()
+	interval := c.HealthCheck.interval()
+	if interval < 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		_, err := c.CheckHealth(c.ctx)
+		if err != nil {
+			log.Logger.Warnf("Health check of TIP failed: %s", err)
+		}
+	}
+}
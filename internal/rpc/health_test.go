@@ -0,0 +1,74 @@
+package rpc
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	tipRPC "github.com/tktip/flyvo-api/pkg/rpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+type healthServer struct {
+	grpc_health_v1.UnimplementedHealthServer
+	status grpc_health_v1.HealthCheckResponse_ServingStatus
+}
+
+func (h *healthServer) Check(context.Context, *grpc_health_v1.HealthCheckRequest) (
+	*grpc_health_v1.HealthCheckResponse, error) {
+	return &grpc_health_v1.HealthCheckResponse{Status: h.status}, nil
+}
+
+// healthClient returns a client connected to a TIP that only implements
+// grpc.health.v1, answering with status, or nothing if status is nil
+func healthClient(t *testing.T, status *grpc_health_v1.HealthCheckResponse_ServingStatus) (*Client, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	if status != nil {
+		grpc_health_v1.RegisterHealthServer(server, &healthServer{status: *status})
+	}
+	go server.Serve(listener)
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Client{grpcConn: conn, tipClient: tipRPC.NewTipFlyvoClient(conn)}
+	return c, func() {
+		conn.Close()
+		server.Stop()
+	}
+}
+
+func TestCheckHealth(t *testing.T) {
+	serving := grpc_health_v1.HealthCheckResponse_SERVING
+	notServing := grpc_health_v1.HealthCheckResponse_NOT_SERVING
+
+	tests := []struct {
+		name   string
+		status *grpc_health_v1.HealthCheckResponse_ServingStatus
+		want   string
+		err    bool
+		method string
+	}{
+		{"serving", &serving, "SERVING", false, HealthCheckGRPC},
+		{"not serving", &notServing, "NOT_SERVING", true, HealthCheckGRPC},
+		{"not implemented", nil, "", true, HealthCheckPing},
+	}
+
+	for _, test := range tests {
+		c, cleanup := healthClient(t, test.status)
+		got, err := c.CheckHealth(context.Background())
+		cleanup()
+		if got != test.want || (err != nil) != test.err {
+			t.Errorf("%s: got %q, %v, want %q, error %t", test.name, got, err, test.want, test.err)
+		}
+		if c.state.healthMethod != test.method {
+			t.Errorf("%s: checked with %s, want %s", test.name, c.state.healthMethod, test.method)
+		}
+	}
+}
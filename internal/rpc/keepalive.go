@@ -0,0 +1,46 @@
+package rpc
+
+import (
+	"time"
+
+	"google.golang.org/grpc/keepalive"
+)
+
+const (
+	// StreamModePersistent - keep one long-lived request stream open to TIP
+	StreamModePersistent = "persistent"
+	// StreamModePoll - open a stream every pollFrequency, and close it once TIP
+	// has no more requests
+	StreamModePoll = "poll"
+
+	// TIP will drop the connection if pinged more often than its enforcement
+	// policy allows, which for gRPC servers defaults to every 5 minutes.
+	defaultKeepaliveTime    = 5 * time.Minute
+	defaultKeepaliveTimeout = 20 * time.Second
+)
+
+// Keepalive - gRPC keepalive settings for the connection to TIP
+type Keepalive struct {
+	// Time is how long the connection can be idle before TIP is pinged
+	Time time.Duration `yaml:"time"`
+	// Timeout is how long to wait for a ping ack before the connection is
+	// considered broken
+	Timeout time.Duration `yaml:"timeout"`
+	// PermitWithoutStream allows pings while there is no active stream
+	PermitWithoutStream bool `yaml:"permitWithoutStream"`
+}
+
+func (k Keepalive) params() keepalive.ClientParameters {
+	params := keepalive.ClientParameters{
+		Time:                k.Time,
+		Timeout:             k.Timeout,
+		PermitWithoutStream: k.PermitWithoutStream,
+	}
+	if params.Time <= 0 {
+		params.Time = defaultKeepaliveTime
+	}
+	if params.Timeout <= 0 {
+		params.Timeout = defaultKeepaliveTimeout
+	}
+	return params
+}
@@ -0,0 +1,49 @@
+package rpc
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/tktip/flyvo-rpc-client/internal/metrics"
+)
+
+var (
+	tipRequests = metrics.NewCounter("flyvo_rpc_tip_requests_total",
+		"Requests received from TIP on the request stream, per path.", "path")
+	tipRequestsInFlight = metrics.NewGauge("flyvo_rpc_tip_requests_in_flight",
+		"Requests from TIP currently being handled.")
+	tipCalls = metrics.NewCounter("flyvo_rpc_tip_calls_total",
+		"Calls made to TIP (events, generic), per method and gRPC status code.", "method", "code")
+	streamOpens = metrics.NewCounter("flyvo_rpc_stream_opens_total",
+		"Request streams opened to TIP, per stream mode.", "mode")
+	streamReconnects = metrics.NewCounter("flyvo_rpc_stream_reconnects_total",
+		"Times the connection to TIP was restored after failing.")
+	streamFailures = metrics.NewCounter("flyvo_rpc_stream_failures_total",
+		"Failed attempts to open or keep a request stream to TIP.")
+	tipHealthChecks = metrics.NewCounter("flyvo_rpc_tip_health_checks_total",
+		"Health checks of TIP, per method (grpc.health.v1 or ping) and result.", "method", "result")
+	tipHealthy = metrics.NewGauge("flyvo_rpc_tip_healthy",
+		"1 if the last health check of TIP succeeded, 0 otherwise.")
+	flyvoRequests = metrics.NewCounter("flyvo_rpc_flyvo_requests_total",
+		"Requests sent to FLYVO, per TIP path and HTTP status (error if no response).",
+		"path", "status")
+	flyvoDuration = metrics.NewHistogram("flyvo_rpc_flyvo_request_duration_seconds",
+		"Time taken by requests to FLYVO, per TIP path.", metrics.DefaultBuckets, "path")
+
+	// lastContact is when TIP was last successfully reached, in unix nanoseconds
+	lastContact int64
+	_           = metrics.NewGaugeFunc("flyvo_rpc_tip_last_contact_age_seconds",
+		"Seconds since TIP was last successfully reached, -1 if never.", lastContactAge)
+)
+
+func contactedTIP() {
+	atomic.StoreInt64(&lastContact, time.Now().UnixNano())
+}
+
+func lastContactAge() float64 {
+	last := atomic.LoadInt64(&lastContact)
+	if last == 0 {
+		return -1
+	}
+	return time.Since(time.Unix(0, last)).Seconds()
+}
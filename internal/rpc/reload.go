@@ -0,0 +1,54 @@
+package rpc
+
+import (
+	"time"
+)
+
+const (
+	defaultConnTimeout   = 15 * time.Second
+	defaultPollFrequency = 100 * time.Millisecond
+)
+
+// settings - the part of the config that Reload can change while running.
+// Requests take a copy when they start, so they never mix old and new settings.
+type settings struct {
+	flyvo         Flyvo
+	pollFrequency time.Duration
+	connTimeout   time.Duration
+	backoff       Backoff
+}
+
+func (c *Client) current() settings {
+	c.settingsLock.RLock()
+	defer c.settingsLock.RUnlock()
+
+	pollFrequency := c.PollFrequency
+	if pollFrequency <= 0 {
+		pollFrequency = defaultPollFrequency
+	}
+	return settings{
+		flyvo:         c.FlyvoApiEndpoints,
+		pollFrequency: pollFrequency,
+		connTimeout:   *c.ConnTimeout,
+		backoff:       c.Backoff,
+	}
+}
+
+// Reload swaps in the FLYVO endpoints, poll frequency, connection timeout and
+// backoff of next. Requests in flight finish with the settings they started with.
+func (c *Client) Reload(next *Client) {
+	timeout := defaultConnTimeout
+	if next.ConnTimeout != nil {
+		timeout = *next.ConnTimeout
+	}
+	backoff := next.Backoff
+	backoff.setDefaults(next.BadConnectSleep)
+
+	c.settingsLock.Lock()
+	defer c.settingsLock.Unlock()
+	c.FlyvoApiEndpoints = next.FlyvoApiEndpoints
+	c.PollFrequency = next.PollFrequency
+	c.BadConnectSleep = next.BadConnectSleep
+	c.ConnTimeout = &timeout
+	c.Backoff = backoff
+}
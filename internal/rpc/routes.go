@@ -0,0 +1,199 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	tipRPC "github.com/tktip/flyvo-api/pkg/rpc"
+)
+
+const (
+	// BodyForward - the body of the TIP request is sent on to FLYVO as is
+	BodyForward = "forward"
+	// BodyNone - no body is sent to FLYVO
+	BodyNone = "none"
+)
+
+// placeholder matches {name} in a route path
+var placeholder = regexp.MustCompile(`{([^{}]+)}`)
+
+// Flyvo - details on the FLYVO api
+type Flyvo struct {
+	RootAddress string `yaml:"address"`
+	// Routes maps a TIP path to a FLYVO endpoint. Entries override the
+	// defaults for known paths, and any other entry adds a new TIP path.
+	Routes map[string]Route `yaml:"routes"`
+
+	// Deprecated: the FLYVO path per TIP path, from before Routes. Used as
+	// the path of the route unless Routes sets one.
+	PathConvertAbsence          string `yaml:"pathConvertAbsence"`
+	PathGetCourses              string `yaml:"pathGetCourses"`
+	PathRegisterAbsence         string `yaml:"pathRegisterAbsence"`
+	PathGetUnauthorizedAbsences string `yaml:"pathGetUnauthorizedAbsences"`
+	PathRegisterSickLeave       string `yaml:"pathRegisterSickLeave"`
+	PathGetSickLeaves           string `yaml:"pathGetSickLeaves"`
+}
+
+// LegacyPath - a deprecated path setting, and the TIP path it routes
+type LegacyPath struct {
+	Setting string
+	TipPath string
+	Path    string
+}
+
+// LegacyPaths returns the deprecated path settings that are set
+func (f *Flyvo) LegacyPaths() []LegacyPath {
+	all := []LegacyPath{
+		{"pathConvertAbsence", tipRPC.PathAbsenceToSickLeave, f.PathConvertAbsence},
+		{"pathGetCourses", tipRPC.PathGetTeacherCourses, f.PathGetCourses},
+		{"pathRegisterAbsence", tipRPC.PathRegisterAbsences, f.PathRegisterAbsence},
+		{"pathGetUnauthorizedAbsences", tipRPC.PathGetAbsences, f.PathGetUnauthorizedAbsences},
+		{"pathRegisterSickLeave", tipRPC.PathRegisterSickLeave, f.PathRegisterSickLeave},
+		{"pathGetSickLeaves", tipRPC.PathGetSickLeaves, f.PathGetSickLeaves},
+	}
+	set := []LegacyPath{}
+	for _, legacy := range all {
+		if legacy.Path != "" {
+			set = append(set, legacy)
+		}
+	}
+	return set
+}
+
+// Route - how a request from TIP is forwarded to FLYVO.
+// Path is appended to the FLYVO root address, and may contain placeholders
+// on the form {name}, which are filled in from the field with the same name
+// in the JSON body of the TIP request. If DateFormat is set, placeholder
+// values that are RFC3339 timestamps are reformatted with it (Go layout).
+type Route struct {
+	Path       string `yaml:"path"`
+	Method     string `yaml:"method"`
+	Body       string `yaml:"body"`
+	DateFormat string `yaml:"dateFormat"`
+}
+
+// defaultRoutes - FLYVO endpoints per TIP path, used for anything not configured
+var defaultRoutes = map[string]Route{
+	tipRPC.PathAbsenceToSickLeave: {
+		Path:   "/absence",
+		Method: http.MethodPost,
+		Body:   BodyForward,
+	},
+	tipRPC.PathGetTeacherCourses: {
+		Path:       "/getoverview/{fromDate}/{toDate}",
+		Method:     http.MethodGet,
+		Body:       BodyNone,
+		DateFormat: "02012006",
+	},
+	tipRPC.PathRegisterAbsences: {
+		Path:   "/absence",
+		Method: http.MethodPost,
+		Body:   BodyForward,
+	},
+	tipRPC.PathGetAbsences: {
+		Path:   "/getinvalidabsenceforperson",
+		Method: http.MethodGet,
+		Body:   BodyForward,
+	},
+	tipRPC.PathRegisterSickLeave: {
+		Path:   "/selfcertification",
+		Method: http.MethodPost,
+		Body:   BodyForward,
+	},
+	tipRPC.PathGetSickLeaves: {
+		Path:   "/getselfcertificationoverview/{vismaId}/{toDate}",
+		Method: http.MethodGet,
+		Body:   BodyNone,
+	},
+}
+
+// route returns the route for a TIP path, with unset fields taken from the
+// defaults. Paths that are neither configured nor known are not ok.
+func (f *Flyvo) route(path string) (Route, bool) {
+	route, known := defaultRoutes[path]
+	for _, legacy := range f.LegacyPaths() {
+		if legacy.TipPath == path {
+			route.Path = legacy.Path
+		}
+	}
+	configured, ok := f.Routes[path]
+	if !ok {
+		return route, known
+	}
+
+	if !known {
+		route = Route{Method: http.MethodPost, Body: BodyForward}
+	}
+	if configured.Path != "" {
+		route.Path = configured.Path
+	}
+	if configured.Method != "" {
+		route.Method = strings.ToUpper(configured.Method)
+	}
+	if configured.Body != "" {
+		route.Body = configured.Body
+	}
+	if configured.DateFormat != "" {
+		route.DateFormat = configured.DateFormat
+	}
+	return route, true
+}
+
+// url builds the full FLYVO url for a route, filling in path placeholders
+// from the body of the request
+func (f *Flyvo) url(route Route, request tipRPC.Generic) (string, error) {
+	names := placeholder.FindAllStringSubmatch(route.Path, -1)
+	if len(names) == 0 {
+		return f.RootAddress + route.Path, nil
+	}
+
+	fields := map[string]interface{}{}
+	decoder := json.NewDecoder(bytes.NewReader(request.Body))
+	decoder.UseNumber()
+	err := decoder.Decode(&fields)
+	if err != nil {
+		return "", err
+	}
+
+	path := route.Path
+	for _, name := range names {
+		value, ok := fields[name[1]]
+		if !ok || value == nil {
+			return "", fmt.Errorf("%w: %s", ErrorMissingParam, name[1])
+		}
+		param := route.param(value)
+		path = strings.Replace(path, name[0], url.PathEscape(param), -1)
+	}
+	return f.RootAddress + path, nil
+}
+
+// param turns a JSON value into a path parameter
+func (r Route) param(value interface{}) string {
+	str, ok := value.(string)
+	if !ok {
+		return fmt.Sprint(value)
+	}
+
+	if r.DateFormat != "" {
+		t, err := time.Parse(time.RFC3339, str)
+		if err == nil {
+			return t.Format(r.DateFormat)
+		}
+	}
+	return str
+}
+
+// body returns what should be sent to FLYVO for the given request
+func (r Route) body(request tipRPC.Generic) io.Reader {
+	if r.Body != BodyForward {
+		return nil
+	}
+	return bytes.NewReader(request.Body)
+}
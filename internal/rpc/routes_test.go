@@ -0,0 +1,89 @@
+package rpc
+
+import (
+	"errors"
+	"testing"
+
+	tipRPC "github.com/tktip/flyvo-api/pkg/rpc"
+)
+
+func TestURL(t *testing.T) {
+	flyvo := Flyvo{RootAddress: "http://flyvo"}
+	dated := Route{Path: "/overview/{fromDate}/{toDate}", DateFormat: "02012006"}
+
+	tests := []struct {
+		name    string
+		route   Route
+		body    string
+		want    string
+		wantErr error
+	}{
+		{"no placeholders", Route{Path: "/absence"}, "not json", "http://flyvo/absence", nil},
+		{"substituted", Route{Path: "/person/{vismaId}"}, `{"vismaId":"123"}`, "http://flyvo/person/123", nil},
+		{"repeated", Route{Path: "/{id}/{id}"}, `{"id":"a"}`, "http://flyvo/a/a", nil},
+		{"number", Route{Path: "/course/{id}"}, `{"id":12345678901234567890}`,
+			"http://flyvo/course/12345678901234567890", nil},
+		{"escaped", Route{Path: "/person/{vismaId}"}, `{"vismaId":"a/b c?d"}`,
+			"http://flyvo/person/a%2Fb%20c%3Fd", nil},
+		{"date reformatted", dated, `{"fromDate":"2021-06-01T00:00:00Z","toDate":"2021-06-30T12:00:00+02:00"}`,
+			"http://flyvo/overview/01062021/30062021", nil},
+		{"not a date kept", dated, `{"fromDate":"today","toDate":"2021-06-30T00:00:00Z"}`,
+			"http://flyvo/overview/today/30062021", nil},
+		{"date without format kept", Route{Path: "/{d}"}, `{"d":"2021-06-01T00:00:00Z"}`,
+			"http://flyvo/2021-06-01T00:00:00Z", nil},
+		{"missing", Route{Path: "/person/{vismaId}"}, `{"other":"1"}`, "", ErrorMissingParam},
+		{"null", Route{Path: "/person/{vismaId}"}, `{"vismaId":null}`, "", ErrorMissingParam},
+	}
+
+	for _, test := range tests {
+		got, err := flyvo.url(test.route, tipRPC.Generic{Body: []byte(test.body)})
+		if test.wantErr != nil {
+			if !errors.Is(err, test.wantErr) {
+				t.Errorf("%s: got error %v, want %v", test.name, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+		} else if got != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+
+	_, err := flyvo.url(Route{Path: "/{id}"}, tipRPC.Generic{Body: []byte("not json")})
+	if err == nil {
+		t.Error("bad body: got no error")
+	}
+}
+
+func TestRoute(t *testing.T) {
+	flyvo := Flyvo{
+		PathConvertAbsence: "/proxy/absence",
+		PathGetSickLeaves:  "/proxy/sickleaves/{vismaId}",
+		Routes: map[string]Route{
+			tipRPC.PathGetSickLeaves:     {Path: "/routed/{vismaId}"},
+			tipRPC.PathRegisterSickLeave: {Method: "put"},
+			"getSomething":               {Path: "/something"},
+		},
+	}
+
+	tests := []struct {
+		path string
+		want Route
+		ok   bool
+	}{
+		{tipRPC.PathAbsenceToSickLeave, Route{Path: "/proxy/absence", Method: "POST", Body: BodyForward}, true},
+		{tipRPC.PathGetSickLeaves, Route{Path: "/routed/{vismaId}", Method: "GET", Body: BodyNone}, true},
+		{tipRPC.PathRegisterSickLeave, Route{Path: "/selfcertification", Method: "PUT", Body: BodyForward}, true},
+		{tipRPC.PathRegisterAbsences, defaultRoutes[tipRPC.PathRegisterAbsences], true},
+		{"getSomething", Route{Path: "/something", Method: "POST", Body: BodyForward}, true},
+		{"unknown", Route{}, false},
+	}
+
+	for _, test := range tests {
+		got, ok := flyvo.route(test.path)
+		if ok != test.ok || got != test.want {
+			t.Errorf("%s: got %+v %t, want %+v %t", test.path, got, ok, test.want, test.ok)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package rpc
+
+import (
+	"sync"
+	"time"
+)
+
+// ConnStatus - state of the connection to TIP
+type ConnStatus struct {
+	Connected           bool       `json:"connected"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	NextRetry           *time.Time `json:"nextRetry,omitempty"`
+	LastError           string     `json:"lastError,omitempty"`
+	// Healthy is the result of the last health check, if any has been made
+	Healthy         *bool      `json:"healthy,omitempty"`
+	HealthCheck     string     `json:"healthCheck,omitempty"`
+	LastHealthCheck *time.Time `json:"lastHealthCheck,omitempty"`
+	HealthError     string     `json:"healthError,omitempty"`
+}
+
+// connState tracks the connection to TIP, as seen by the request stream
+type connState struct {
+	lock      sync.RWMutex
+	connected bool
+	failures  int
+	nextRetry time.Time
+	lastError error
+
+	healthMethod  string
+	healthChecked time.Time
+	healthError   error
+}
+
+// succeeded records a successful connection, returning true if the client was
+// not connected before
+func (s *connState) succeeded() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	reconnected := !s.connected
+	s.connected = true
+	s.failures = 0
+	s.nextRetry = time.Time{}
+	return reconnected
+}
+
+// failed records a failed connection, returning how long to wait before
+// trying again
+func (s *connState) failed(err error, backoff Backoff) (int, time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.connected = false
+	s.failures++
+	s.lastError = err
+	wait := backoff.delay(s.failures)
+	s.nextRetry = time.Now().Add(wait)
+	return s.failures, wait
+}
+
+// checked records the result of a health check
+func (s *connState) checked(method string, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.healthMethod = method
+	s.healthChecked = time.Now()
+	s.healthError = err
+}
+
+func (s *connState) status() ConnStatus {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	status := ConnStatus{
+		Connected:           s.connected,
+		ConsecutiveFailures: s.failures,
+	}
+	if !s.nextRetry.IsZero() {
+		next := s.nextRetry
+		status.NextRetry = &next
+	}
+	if s.lastError != nil {
+		status.LastError = s.lastError.Error()
+	}
+	if !s.healthChecked.IsZero() {
+		healthy := s.healthError == nil
+		checked := s.healthChecked
+		status.Healthy = &healthy
+		status.HealthCheck = s.healthMethod
+		status.LastHealthCheck = &checked
+		if s.healthError != nil {
+			status.HealthError = s.healthError.Error()
+		}
+	}
+	return status
+}
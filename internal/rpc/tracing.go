@@ -0,0 +1,35 @@
+package rpc
+
+import (
+	"context"
+
+	"github.com/tktip/flyvo-rpc-client/internal/tracing"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// traceUnary records a span for each call to TIP, passing the trace context on
+// in the call metadata. Retries happen within the span.
+func (c *Client) traceUnary(
+	ctx context.Context,
+	method string,
+	req, reply interface{},
+	cc *grpc.ClientConn,
+	invoker grpc.UnaryInvoker,
+	opts ...grpc.CallOption,
+) error {
+	ctx, span := tracing.Start(ctx, method, tracing.KindClient)
+	defer span.End()
+	span.SetAttribute("rpc.system", "grpc")
+	span.SetAttribute("rpc.method", method)
+
+	if traceparent := tracing.Traceparent(ctx); traceparent != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, tracing.TraceparentHeader, traceparent)
+	}
+
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	span.SetAttribute("rpc.grpc.status_code", int(status.Code(err)))
+	span.SetError(err)
+	return err
+}
@@ -0,0 +1,130 @@
+// Package secret holds config values that must not end up in logs, and
+// resolves them from files, environment variables or the Windows credential
+// store, so they don't have to be written in plaintext in the config.
+package secret
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+const masked = "***"
+
+// ErrorUnsupported - the reference kind can't be resolved on this platform
+var ErrorUnsupported = errors.New("only supported on Windows")
+
+// Secret - a config value that is masked when printed, logged or marshalled.
+// Use Value to get the actual value.
+//
+// A Secret may be given as a reference, which Resolve replaces by the value:
+//
+//	file::/path/to/file     contents of the file, without trailing newlines
+//	secret::name            contents of /run/secrets/name (docker secrets)
+//	env::NAME               the environment variable NAME
+//	dpapi::base64           value encrypted with DPAPI (Windows), see Protect
+//	wincred::target         generic credential in Windows Credential Manager
+//
+// Anything else is taken as the value itself.
+type Secret string
+
+// Value returns the actual value
+func (s Secret) Value() string {
+	return string(s)
+}
+
+// String masks the value, so it does not show up when formatted with %v or %+v
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return masked
+}
+
+// GoString masks the value when formatted with %#v
+func (s Secret) GoString() string {
+	return `"` + s.String() + `"`
+}
+
+// MarshalJSON masks the value, e.g. in json log fields
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + s.String() + `"`), nil
+}
+
+// MarshalYAML masks the value
+func (s Secret) MarshalYAML() (interface{}, error) {
+	return s.String(), nil
+}
+
+// Resolve returns the secret a reference points to, or s itself if it is not
+// a reference
+func (s Secret) Resolve() (Secret, error) {
+	parts := strings.SplitN(string(s), "::", 2)
+	if len(parts) < 2 {
+		return s, nil
+	}
+
+	var value string
+	var err error
+	switch parts[0] {
+	case "file":
+		value, err = readFile(parts[1])
+	case "secret":
+		value, err = readFile(path.Join("/run/secrets", parts[1]))
+	case "env":
+		var ok bool
+		value, ok = os.LookupEnv(parts[1])
+		if !ok {
+			err = fmt.Errorf("environment variable %s is not set", parts[1])
+		}
+	case "dpapi":
+		value, err = unprotect(parts[1])
+	case "wincred":
+		value, err = readCredential(parts[1])
+	default:
+		// Not a known reference, so the '::' is part of the value
+		return s, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", parts[0], err)
+	}
+	if value == "" {
+		return "", fmt.Errorf("%s::%s is empty", parts[0], parts[1])
+	}
+	return Secret(value), nil
+}
+
+// IsReference returns true if s points to where the secret is kept, rather
+// than being the secret itself
+func (s Secret) IsReference() bool {
+	parts := strings.SplitN(string(s), "::", 2)
+	if len(parts) < 2 {
+		return false
+	}
+	switch parts[0] {
+	case "file", "secret", "env", "dpapi", "wincred":
+		return true
+	}
+	return false
+}
+
+// Protect encrypts value with DPAPI for this machine, returning a dpapi::
+// reference that any account on the machine, such as the service, can resolve
+func Protect(value string) (Secret, error) {
+	encrypted, err := protect(value)
+	if err != nil {
+		return "", err
+	}
+	return Secret("dpapi::" + encrypted), nil
+}
+
+func readFile(file string) (string, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
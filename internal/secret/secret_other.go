@@ -0,0 +1,15 @@
+// +build !windows
+
+package secret
+
+func protect(string) (string, error) {
+	return "", ErrorUnsupported
+}
+
+func unprotect(string) (string, error) {
+	return "", ErrorUnsupported
+}
+
+func readCredential(string) (string, error) {
+	return "", ErrorUnsupported
+}
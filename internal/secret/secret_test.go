@@ -0,0 +1,94 @@
+package secret
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	withNewline := filepath.Join(dir, "key")
+	empty := filepath.Join(dir, "empty")
+	ioutil.WriteFile(withNewline, []byte("from file\r\n"), 0600)
+	ioutil.WriteFile(empty, []byte("\n"), 0600)
+
+	os.Setenv("SECRET_TEST_VALUE", "from env")
+	defer os.Unsetenv("SECRET_TEST_VALUE")
+	os.Unsetenv("SECRET_TEST_UNSET")
+
+	tests := []struct {
+		secret Secret
+		want   Secret
+		err    bool
+	}{
+		{"plain", "plain", false},
+		{"", "", false},
+		{"http::x", "http::x", false},
+		{"a::b::c", "a::b::c", false},
+		{Secret("file::" + withNewline), "from file", false},
+		{Secret("file::" + empty), "", true},
+		{Secret("file::" + filepath.Join(dir, "missing")), "", true},
+		{"env::SECRET_TEST_VALUE", "from env", false},
+		{"env::SECRET_TEST_UNSET", "", true},
+	}
+
+	for _, test := range tests {
+		got, err := test.secret.Resolve()
+		if (err != nil) != test.err {
+			t.Errorf("%s: got error %v, want error %t", test.secret.Value(), err, test.err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.secret.Value(), got.Value(), test.want.Value())
+		}
+	}
+}
+
+func TestIsReference(t *testing.T) {
+	tests := map[Secret]bool{
+		"plain":           false,
+		"http::x":         false,
+		"file::/run/key":  true,
+		"secret::key":     true,
+		"env::KEY":        true,
+		"dpapi::AQAAAA==": true,
+		"wincred::flyvo":  true,
+		"":                false,
+	}
+
+	for s, want := range tests {
+		if got := s.IsReference(); got != want {
+			t.Errorf("%s: got %t, want %t", s.Value(), got, want)
+		}
+	}
+}
+
+func TestMasked(t *testing.T) {
+	s := struct {
+		Key   Secret `json:"key"`
+		Empty Secret `json:"empty"`
+	}{Key: "hunter2"}
+
+	for _, got := range []string{fmt.Sprint(s.Key), fmt.Sprintf("%+v", s), fmt.Sprintf("%#v", s)} {
+		if got == "" || strings.Contains(got, "hunter2") {
+			t.Errorf("got %q, want the value masked", got)
+		}
+	}
+
+	out, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"key":"***","empty":""}`; string(out) != want {
+		t.Errorf("got %s, want %s", out, want)
+	}
+}
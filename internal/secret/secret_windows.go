@@ -0,0 +1,125 @@
+// +build windows
+
+package secret
+
+import (
+	"encoding/base64"
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	cryptProtectUIForbidden  = 0x1
+	cryptProtectLocalMachine = 0x4
+	credTypeGeneric          = 1
+	maxBlobSize              = 1 << 30
+	errorNotFound            = syscall.Errno(1168)
+)
+
+var (
+	crypt32  = syscall.NewLazyDLL("crypt32.dll")
+	advapi32 = syscall.NewLazyDLL("advapi32.dll")
+	kernel32 = syscall.NewLazyDLL("kernel32.dll")
+
+	procCryptProtectData   = crypt32.NewProc("CryptProtectData")
+	procCryptUnprotectData = crypt32.NewProc("CryptUnprotectData")
+	procCredReadW          = advapi32.NewProc("CredReadW")
+	procCredFree           = advapi32.NewProc("CredFree")
+	procLocalFree          = kernel32.NewProc("LocalFree")
+)
+
+// dataBlob - DATA_BLOB
+type dataBlob struct {
+	size uint32
+	data *byte
+}
+
+// credential - CREDENTIALW, up to the fields used
+type credential struct {
+	flags       uint32
+	credType    uint32
+	targetName  *uint16
+	comment     *uint16
+	lastWritten syscall.Filetime
+	blobSize    uint32
+	blob        *byte
+}
+
+func newBlob(data []byte) *dataBlob {
+	if len(data) == 0 {
+		return &dataBlob{}
+	}
+	return &dataBlob{size: uint32(len(data)), data: &data[0]}
+}
+
+func (b *dataBlob) bytes() []byte {
+	out := make([]byte, b.size)
+	if b.size == 0 {
+		return out
+	}
+	copy(out, (*[maxBlobSize]byte)(unsafe.Pointer(b.data))[:b.size:b.size])
+	return out
+}
+
+func protect(value string) (string, error) {
+	var out dataBlob
+	r, _, err := procCryptProtectData.Call(
+		uintptr(unsafe.Pointer(newBlob([]byte(value)))), 0, 0, 0, 0,
+		cryptProtectUIForbidden|cryptProtectLocalMachine,
+		uintptr(unsafe.Pointer(&out)))
+	if r == 0 {
+		return "", err
+	}
+	defer procLocalFree.Call(uintptr(unsafe.Pointer(out.data)))
+	return base64.StdEncoding.EncodeToString(out.bytes()), nil
+}
+
+func unprotect(encoded string) (string, error) {
+	encrypted, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+
+	var out dataBlob
+	r, _, err := procCryptUnprotectData.Call(
+		uintptr(unsafe.Pointer(newBlob(encrypted))), 0, 0, 0, 0,
+		cryptProtectUIForbidden,
+		uintptr(unsafe.Pointer(&out)))
+	if r == 0 {
+		return "", err
+	}
+	defer procLocalFree.Call(uintptr(unsafe.Pointer(out.data)))
+	return string(out.bytes()), nil
+}
+
+// readCredential reads the password of a generic credential, as stored by
+// "cmdkey /generic:target /user:name /pass" for the account the service runs as
+func readCredential(target string) (string, error) {
+	name, err := syscall.UTF16PtrFromString(target)
+	if err != nil {
+		return "", err
+	}
+
+	var cred *credential
+	r, _, err := procCredReadW.Call(uintptr(unsafe.Pointer(name)), credTypeGeneric, 0,
+		uintptr(unsafe.Pointer(&cred)))
+	if r == 0 {
+		if err == errorNotFound {
+			return "", fmt.Errorf("%s not found in Credential Manager", target)
+		}
+		return "", err
+	}
+	defer procCredFree.Call(uintptr(unsafe.Pointer(cred)))
+
+	blob := (&dataBlob{size: cred.blobSize, data: cred.blob}).bytes()
+	// cmdkey and the Credential Manager store the password as UTF-16
+	if len(blob)%2 != 0 {
+		return string(blob), nil
+	}
+	chars := make([]uint16, len(blob)/2)
+	for i := range chars {
+		chars[i] = uint16(blob[2*i]) | uint16(blob[2*i+1])<<8
+	}
+	return syscall.UTF16ToString(chars), nil
+}
@@ -1,11 +1,62 @@
 package tipservice
 
 import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tktip/cfger"
 	"github.com/tktip/flyvo-rpc-client/internal/api"
+	"github.com/tktip/flyvo-rpc-client/internal/log"
+	"github.com/tktip/flyvo-rpc-client/internal/secret"
+	"github.com/tktip/flyvo-rpc-client/internal/tracing"
+	"github.com/tktip/flyvo-rpc-client/pkg/eventHook"
+	filehook "github.com/tktip/flyvo-rpc-client/pkg/fileHook"
 )
 
+// Config - the config file, shared by the Windows service and the Linux binary.
+// Syslog and Journald only apply on Linux, NoEventLog only on Windows.
+// WatchConfig is how often the file is checked for changes to reload, if set.
+// Any setting can be overridden by environment variables and flags.
 type Config struct {
-	LogFile  string     `json:"logFile" yaml:"logFile"`
-	LogLevel string     `json:"logLevel" yaml:"logLevel"`
-	Api      api.Server `json:"api" yaml:"api"`
+	LogFile     string            `json:"logFile" yaml:"logFile"`
+	Rotation    filehook.Rotation `json:"logRotation" yaml:"logRotation"`
+	LogLevel    string            `json:"logLevel" yaml:"logLevel"`
+	LogFormat   string            `json:"logFormat" yaml:"logFormat"`
+	Redaction   log.Redaction     `json:"logRedaction" yaml:"logRedaction"`
+	NoEventLog  bool              `json:"noEventLog" yaml:"noEventLog"`
+	Syslog      eventHook.Syslog  `json:"syslog" yaml:"syslog"`
+	Journald    bool              `json:"journald" yaml:"journald"`
+	WatchConfig time.Duration     `json:"watchConfig" yaml:"watchConfig"`
+	Api         api.Server        `json:"api" yaml:"api"`
+	Tracing     tracing.Config    `json:"tracing" yaml:"tracing"`
+
+	// overridden - where the settings not from the file came from, by path
+	overridden map[string]string
+	// references - what the secrets given as references were, by path
+	references map[string]secret.Secret
+}
+
+// Load reads the config from a cfger source, e.g. file::/etc/flyvo/config.yml,
+// and applies the environment variables and then the flags on top. Without a
+// source, the config only has what is given in the environment and flags.
+// Secrets given as references, e.g. file::/run/keys/api-key, are then resolved.
+func Load(source string) (*Config, error) {
+	conf := &Config{}
+	if source != "" {
+		_, err := cfger.ReadStructuredCfg(source, conf)
+		if err != nil {
+			return nil, err
+		}
+	}
+	found := conf.applyOverrides()
+	found = append(found, conf.resolveSecrets()...)
+	return conf, found.err()
+}
+
+// Level returns the configured log level, info if none is set
+func (c *Config) Level() (logrus.Level, error) {
+	if c.LogLevel == "" {
+		return logrus.InfoLevel, nil
+	}
+	return logrus.ParseLevel(c.LogLevel)
 }
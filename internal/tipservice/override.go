@@ -0,0 +1,385 @@
+package tipservice
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tktip/flyvo-rpc-client/internal/secret"
+)
+
+// EnvPrefix - environment variables named EnvPrefix and the path of a setting,
+// e.g. FLYVO_RPC_API_RPC_SERVERADDRESS, override the config file
+const EnvPrefix = "FLYVO_RPC_"
+
+// flagOverrides - settings given as command line flags, by path. Set while
+// flags are parsed, before any config is loaded.
+var flagOverrides = map[string]string{}
+
+// EnvName returns the environment variable that overrides a setting
+func EnvName(path string) string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(path, ".", "_", -1))
+}
+
+// AddFlags adds a flag per setting, named by its path, e.g. -api.rpc.serverAddress
+func AddFlags(flags *flag.FlagSet) {
+	for _, path := range settingsOf("", reflect.TypeOf(Config{})) {
+		flags.Var(flagOverride(path), path, "overrides "+path)
+	}
+}
+
+// FlagArgs returns the settings given as flags, as arguments for the service.
+// Secrets are left out unless they are references, as the arguments are
+// stored in plaintext.
+func FlagArgs() []string {
+	args := []string{}
+	for path, value := range flagOverrides {
+		if !isSecret(path) || secret.Secret(value).IsReference() {
+			args = append(args, "-"+path+"="+value)
+		}
+	}
+	sort.Strings(args)
+	return args
+}
+
+// SecretFlags returns the secret settings given as flags with the secret
+// itself, rather than a reference to it
+func SecretFlags() []string {
+	secrets := []string{}
+	for path, value := range flagOverrides {
+		if isSecret(path) && !secret.Secret(value).IsReference() {
+			secrets = append(secrets, path)
+		}
+	}
+	sort.Strings(secrets)
+	return secrets
+}
+
+// isSecret returns true if the setting at path is a secret.Secret, or a list
+// or map of them
+func isSecret(path string) bool {
+	t := reflect.TypeOf(Config{})
+	for _, key := range strings.Split(path, ".") {
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct {
+			return false
+		}
+		field, ok := fieldOfType(t, key)
+		if !ok {
+			return false
+		}
+		t = field.Type
+	}
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Map {
+		t = t.Elem()
+	}
+	return t == secretType
+}
+
+func fieldOfType(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		name, ok := settingName(t.Field(i))
+		if !ok {
+			continue
+		}
+		if name == "" {
+			if field, found := fieldOfType(t.Field(i).Type, key); found {
+				return field, true
+			}
+		} else if name == key {
+			return t.Field(i), true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+type flagOverride string
+
+func (f flagOverride) String() string {
+	return flagOverrides[string(f)]
+}
+
+func (f flagOverride) Set(value string) error {
+	flagOverrides[string(f)] = value
+	return nil
+}
+
+// applyOverrides sets the settings given in the environment, and then those
+// given as flags, recording where each came from
+func (c *Config) applyOverrides() problems {
+	found := problems{}
+	c.overridden = map[string]string{}
+	root := reflect.ValueOf(c).Elem()
+	for _, path := range settingsOf("", root.Type()) {
+		name := EnvName(path)
+		if value, ok := os.LookupEnv(name); ok {
+			err := setPath(root, strings.Split(path, "."), value)
+			if err != nil {
+				found.add(name, "%s", err)
+			}
+			c.overridden[path] = name
+		}
+		if value, ok := flagOverrides[path]; ok {
+			err := setPath(root, strings.Split(path, "."), value)
+			if err != nil {
+				found.add("-"+path, "%s", err)
+			}
+			c.overridden[path] = "flag"
+		}
+	}
+	return found
+}
+
+// unknownEnv lists the environment variables with EnvPrefix that match no setting
+func unknownEnv() []string {
+	known := map[string]bool{}
+	for _, path := range settingsOf("", reflect.TypeOf(Config{})) {
+		known[EnvName(path)] = true
+	}
+
+	unknown := []string{}
+	for _, env := range os.Environ() {
+		name := strings.SplitN(env, "=", 2)[0]
+		if strings.HasPrefix(name, EnvPrefix) && !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// Effective lists every setting that is set, as "path: value", with secrets
+// masked by their type and overridden settings marked with where they came from
+func (c *Config) Effective() []string {
+	lines := []string{}
+	c.effective("", reflect.ValueOf(c).Elem(), &lines)
+	return lines
+}
+
+func (c *Config) effective(path string, v reflect.Value, lines *[]string) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			c.effective(path, v.Elem(), lines)
+		}
+		return
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			name, ok := settingName(v.Type().Field(i))
+			if ok {
+				c.effective(joinPath(path, name), v.Field(i), lines)
+			}
+		}
+		return
+	case reflect.Map:
+		keys := []string{}
+		for _, key := range v.MapKeys() {
+			keys = append(keys, key.String())
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			c.effective(joinPath(path, key), v.MapIndex(reflect.ValueOf(key)), lines)
+		}
+		return
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Struct {
+			for i := 0; i < v.Len(); i++ {
+				c.effective(fmt.Sprintf("%s[%d]", path, i), v.Index(i), lines)
+			}
+			return
+		}
+	}
+
+	if isZero(v) {
+		return
+	}
+	value := fmt.Sprint(v.Interface())
+	if v.Kind() == reflect.Slice {
+		parts := []string{}
+		for i := 0; i < v.Len(); i++ {
+			parts = append(parts, fmt.Sprint(v.Index(i).Interface()))
+		}
+		value = strings.Join(parts, ",")
+	}
+	for setting, from := range c.overridden {
+		if path == setting || strings.HasPrefix(path, setting+".") {
+			value += " (" + from + ")"
+		}
+	}
+	*lines = append(*lines, path+": "+value)
+}
+
+func isZero(v reflect.Value) bool {
+	if v.Kind() == reflect.Slice {
+		return v.Len() == 0
+	}
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
+
+// settingName returns the yaml name of a struct field, "" for inlined fields.
+// Not ok for fields that are not settings.
+func settingName(field reflect.StructField) (string, bool) {
+	tag := strings.Split(field.Tag.Get("yaml"), ",")
+	if field.PkgPath != "" || tag[0] == "-" {
+		return "", false
+	}
+	if tag[0] == "" && len(tag) > 1 && tag[1] == "inline" {
+		return "", true
+	}
+	if tag[0] == "" {
+		return strings.ToLower(field.Name), true
+	}
+	return tag[0], true
+}
+
+// settingsOf lists the paths of the settings of t that can be given as a
+// string. Lists and maps of structs, such as routes and credentials, can only
+// be set in the file.
+func settingsOf(prefix string, t reflect.Type) []string {
+	if fromString(t) {
+		return []string{prefix}
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+
+	settings := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		name, ok := settingName(t.Field(i))
+		if ok {
+			settings = append(settings, settingsOf(joinPath(prefix, name), t.Field(i).Type)...)
+		}
+	}
+	return settings
+}
+
+// fromString returns true if setValue can set a value of type t
+func fromString(t reflect.Type) bool {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String, reflect.Bool, reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return true
+	case reflect.Slice:
+		return t.Elem().Kind() == reflect.String
+	case reflect.Map:
+		return t.Key().Kind() == reflect.String && t.Elem().Kind() == reflect.String
+	}
+	return false
+}
+
+// setPath sets the setting at path below v, creating structs on the way
+func setPath(v reflect.Value, path []string, value string) error {
+	for v.Kind() == reflect.Ptr && !fromString(v.Type()) {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+	if len(path) == 0 {
+		return setValue(v, value)
+	}
+
+	field, ok := fieldByName(v, path[0])
+	if !ok {
+		return fmt.Errorf("unknown setting %s", path[0])
+	}
+	return setPath(field, path[1:], value)
+}
+
+func fieldByName(v reflect.Value, key string) (reflect.Value, bool) {
+	for i := 0; i < v.NumField(); i++ {
+		name, ok := settingName(v.Type().Field(i))
+		if !ok {
+			continue
+		}
+		if name == "" {
+			if field, found := fieldByName(v.Field(i), key); found {
+				return field, true
+			}
+		} else if name == key {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// setValue parses value into v. Lists are comma separated, and maps are
+// comma separated key=value pairs.
+func setValue(v reflect.Value, value string) error {
+	if v.Kind() == reflect.Ptr {
+		ptr := reflect.New(v.Type().Elem())
+		err := setValue(ptr.Elem(), value)
+		if err != nil {
+			return err
+		}
+		v.Set(ptr)
+		return nil
+	}
+
+	if v.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		list := reflect.MakeSlice(v.Type(), 0, 0)
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = reflect.Append(list, reflect.ValueOf(item).Convert(v.Type().Elem()))
+			}
+		}
+		v.Set(list)
+	case reflect.Map:
+		m := reflect.MakeMap(v.Type())
+		for _, pair := range strings.Split(value, ",") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("'%s' is not key=value", pair)
+			}
+			key := reflect.ValueOf(strings.TrimSpace(kv[0])).Convert(v.Type().Key())
+			m.SetMapIndex(key, reflect.ValueOf(kv[1]).Convert(v.Type().Elem()))
+		}
+		v.Set(m)
+	default:
+		return fmt.Errorf("can't be set from a string")
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package tipservice
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tktip/flyvo-rpc-client/internal/secret"
+)
+
+func TestSetPath(t *testing.T) {
+	tests := []struct {
+		path  string
+		value string
+		got   func(c *Config) interface{}
+		want  interface{}
+	}{
+		{"logLevel", "debug", func(c *Config) interface{} { return c.LogLevel }, "debug"},
+		{"watchConfig", "10s", func(c *Config) interface{} { return c.WatchConfig }, 10 * time.Second},
+		{"api.requireClientCert", "true", func(c *Config) interface{} { return c.Api.RequireCert }, true},
+		{"api.rpc.serverAddress", "tip:50051",
+			func(c *Config) interface{} { return c.Api.RpcClient.RpcServerAddress }, "tip:50051"},
+		{"api.rpc.maxInFlight", "5", func(c *Config) interface{} { return c.Api.RpcClient.MaxInFlight }, 5},
+		{"api.rpc.connTimeout", "5s",
+			func(c *Config) interface{} { return *c.Api.RpcClient.ConnTimeout }, 5 * time.Second},
+		{"api.rpc.backoff.unaryRetries", "3",
+			func(c *Config) interface{} { return *c.Api.RpcClient.Backoff.UnaryRetries }, 3},
+		{"tracing.sampleRatio", "0.5", func(c *Config) interface{} { return *c.Tracing.SampleRatio }, 0.5},
+		{"api.rpc.auth.oauth2.scopes", "a, b,,c",
+			func(c *Config) interface{} { return c.Api.RpcClient.Auth.OAuth2.Scopes }, []string{"a", "b", "c"}},
+		{"logRedaction.fields", "vismaId",
+			func(c *Config) interface{} { return c.Redaction.Fields }, []string{"vismaId"}},
+		{"api.rpc.auth.apiKey", "key",
+			func(c *Config) interface{} { return c.Api.RpcClient.Auth.APIKey }, secret.Secret("key")},
+		{"api.tls.keyPassphrase", "env::PASS",
+			func(c *Config) interface{} { return c.Api.TLS.KeyPassphrase }, secret.Secret("env::PASS")},
+		{"tracing.headers", "authorization=Bearer a=b, x=y",
+			func(c *Config) interface{} { return c.Tracing.Headers },
+			map[string]secret.Secret{"authorization": "Bearer a=b", "x": "y"}},
+	}
+
+	for _, test := range tests {
+		c := &Config{}
+		err := setPath(reflect.ValueOf(c).Elem(), strings.Split(test.path, "."), test.value)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.path, err)
+			continue
+		}
+		if got := test.got(c); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %#v, want %#v", test.path, got, test.want)
+		}
+	}
+}
+
+func TestSetPathErrors(t *testing.T) {
+	tests := []struct {
+		path  string
+		value string
+	}{
+		{"api.nope", "1"},
+		{"watchConfig", "soon"},
+		{"api.rpc.maxInFlight", "many"},
+		{"api.requireClientCert", "maybe"},
+		{"tracing.headers", "authorization"},
+		{"api.rpc.backoff", "fast"},
+	}
+
+	for _, test := range tests {
+		c := &Config{}
+		err := setPath(reflect.ValueOf(c).Elem(), strings.Split(test.path, "."), test.value)
+		if err == nil {
+			t.Errorf("%s=%s: got no error", test.path, test.value)
+		}
+	}
+}
+
+func TestSecretFlags(t *testing.T) {
+	defer func() { flagOverrides = map[string]string{} }()
+	flagOverrides = map[string]string{
+		"api.port":                   "8080",
+		"api.rpc.auth.apiKey":        "plain",
+		"api.rpc.auth.oauth2.scopes": "a",
+		"api.tls.keyPassphrase":      "file::/run/keys/pass",
+		"tracing.headers":            "a=b",
+	}
+
+	want := []string{"-api.port=8080", "-api.rpc.auth.oauth2.scopes=a", "-api.tls.keyPassphrase=file::/run/keys/pass"}
+	if got := FlagArgs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got flag args %q, want %q", got, want)
+	}
+	want = []string{"api.rpc.auth.apiKey", "tracing.headers"}
+	if got := SecretFlags(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got secret flags %q, want %q", got, want)
+	}
+}
@@ -1,16 +1,10 @@
 package tipservice
 
-// +build windows
 import (
-	"errors"
-	"os"
-	"strings"
+	"time"
 
-	"github.com/sirupsen/logrus"
-	"github.com/tktip/cfger"
-	"github.com/tktip/flyvo-rpc-client/internal/api"
 	"github.com/tktip/flyvo-rpc-client/internal/log"
-	"github.com/tktip/flyvo-rpc-client/pkg/eventHook"
+	"github.com/tktip/flyvo-rpc-client/internal/tracing"
 	filehook "github.com/tktip/flyvo-rpc-client/pkg/fileHook"
 
 	"context"
@@ -19,29 +13,39 @@ import (
 )
 
 type program struct {
-	args       []string   `json:"-" yaml:"-"`
-	LogFile    string     `json:"logFile" yaml:"logFile"`
-	LogLevel   string     `json:"logLevel" yaml:"logLevel"`
-	NoEventLog bool       `json:"noEventLog" yaml:"noEventLog"`
-	Api        api.Server `json:"api" yaml:"api"`
+	Config
+
+	source  string
+	cancel  context.CancelFunc
+	stopped chan struct{}
 }
 
-func (p *program) readConfig(configFile string) (err error) {
-	configKV := strings.Split(configFile, "=")
-	if configKV[0] != "configFile" || len(configKV) < 2 || configKV[1] == "" {
-		log.Logger.Debug("No config provided")
-		return errors.New("missing configFile parameter")
+func (p *program) readConfig() error {
+	if p.source == "" {
+		log.Logger.Debug("No config file provided, using environment and flags only")
 	}
 
-	configFile = configKV[1]
-	_, err = cfger.ReadStructuredCfg("file::"+configFile, p)
-	log.Logger.Infof("Contents: %+v", *p)
-	return err
+	conf, warnings, err := LoadWarn(p.source)
+	if err != nil {
+		return err
+	}
+	for _, warning := range warnings {
+		log.Logger.Warnf("Config: %s (ignored)", warning)
+	}
+	p.Config = *conf
+	log.Logger.Info("Effective config:")
+	for _, line := range p.Effective() {
+		log.Logger.Info("  " + line)
+	}
+	return nil
 }
 
 func (p *program) Start(s service.Service) error {
 	// Start should not block. Do the actual work async.
-	go p.run()
+	var ctx context.Context
+	ctx, p.cancel = context.WithCancel(context.Background())
+	p.stopped = make(chan struct{})
+	go p.run(ctx)
 	return nil
 }
 
@@ -54,37 +58,40 @@ func (p *program) initialize() error {
 	log.Logger.Infof("Flyvo api address:   %s", p.Api.RpcClient.FlyvoApiEndpoints.RootAddress)
 	log.Logger.Infof("Log file:            %s", p.LogFile)
 	log.Logger.Infof("Log level:           %s", p.LogLevel)
+	log.Logger.Infof("Log format:          %s", p.LogFormat)
 
-	if p.LogLevel != "" {
-		level, err := logrus.ParseLevel(p.LogLevel)
-		if err != nil {
-			log.Logger.Warnf("Could not parse level '%s', falling back to default (info). Error: %s", p.LogLevel, err.Error())
-		} else {
-			log.Logger.SetLevel(level)
-			log.Logger.Infof("Set log level to %s", level)
-		}
-	}
+	level, _ := p.Level()
+	log.Logger.SetLevel(level)
+	log.Logger.Infof("Set log level to %s", level)
 
-	if !p.NoEventLog {
-		log.Logger.Info("Event log not disabled, adding event logger hook")
-		hook := eventHook.NewHook(logger)
-		log.Logger.AddHook(hook)
+	err := log.SetFormat(p.LogFormat)
+	if err != nil {
+		log.Logger.Warnf("%s, falling back to text", err)
+	}
+	err = log.SetRedaction(p.Redaction)
+	if err != nil {
+		log.Logger.Warnf("%s, falling back to masking the default fields", err)
 	}
 
+	p.addSystemLogHooks()
+
 	if p.LogFile != "" {
 		log.Logger.Info()
-		fHook := filehook.NewHook(p.LogFile)
+		fHook := filehook.NewHook(p.LogFile, p.Rotation)
 		log.Logger.AddHook(fHook)
 		log.Logger.Info("Logging to file enabled")
 	} else {
-		log.Logger.Warn("No log file location set - only logging to event log (if not disabled)")
+		log.Logger.Warn("No log file location set - only logging to the system log (if enabled)")
 	}
+
+	tracing.Setup(p.Tracing)
 	return nil
 }
 
-func (p *program) run() {
+func (p *program) run(ctx context.Context) {
+	defer close(p.stopped)
 
-	err := p.readConfig(os.Args[1])
+	err := p.readConfig()
 	if err != nil {
 		log.Logger.Fatal("Failed to read config: " + err.Error())
 	}
@@ -95,13 +102,43 @@ func (p *program) run() {
 		log.Logger.Fatal("Failed to initalize: " + err.Error())
 	}
 
-	err = p.Api.Run(context.Background())
+	reloader, err := NewReloader(p.source, &p.Api)
 	if err != nil {
+		log.Logger.Fatal("Failed to read config for reloading: " + err.Error())
+	}
+	p.Api.OnReload(reloader.Reload)
+	go reloadOnSignal(ctx, reloader)
+	if p.WatchConfig > 0 {
+		go reloader.Watch(ctx, p.WatchConfig)
+	}
+
+	err = p.Api.Run(ctx)
+	if err != nil && ctx.Err() == nil {
 		log.Logger.Fatalf("Failed to start api: %+v", err)
+	} else if err != nil {
+		log.Logger.Errorf("Api stopped: %s", err)
 	}
+
+	flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tracing.Shutdown(flushCtx)
 }
+
+// Stop cancels the program and waits for requests in flight, first on the api
+// and then from TIP, to finish. The service ends once Stop returns.
 func (p *program) Stop(s service.Service) error {
 	log.Logger.Warn("Shutting down...")
-	// Stop should not block. Return with a few seconds.
+	p.cancel()
+
+	wait := 2 * p.Api.ShutdownTimeout
+	if wait <= 0 {
+		wait = time.Minute
+	}
+	select {
+	case <-p.stopped:
+		log.Logger.Info("Stopped")
+	case <-time.After(wait):
+		log.Logger.Errorf("Requests still in flight after %s, stopping anyway", wait)
+	}
 	return nil
 }
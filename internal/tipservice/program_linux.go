@@ -0,0 +1,90 @@
+// +build linux
+
+package tipservice
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/kardianos/service"
+	"github.com/tktip/flyvo-rpc-client/internal/log"
+	"github.com/tktip/flyvo-rpc-client/pkg/eventHook"
+)
+
+const serviceName = "flyvo-rpc-client"
+
+// serviceDependencies - the systemd unit starts once the network is up
+var serviceDependencies = []string{
+	"After=network-online.target",
+	"Wants=network-online.target",
+}
+
+// serviceOptions makes systemctl reload send SIGHUP, and stops the program on
+// SIGTERM or SIGINT
+func serviceOptions() service.KeyValue {
+	return service.KeyValue{
+		"ReloadSignal": "HUP",
+		"RunWait":      waitForStopSignal,
+	}
+}
+
+// waitForStopSignal returns on SIGTERM or SIGINT, so requests in flight can
+// finish. A second signal exits right away.
+func waitForStopSignal() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	sig := <-signals
+	log.Logger.Warnf("Received %s, shutting down...", sig)
+
+	go func() {
+		sig := <-signals
+		log.Logger.Errorf("Received %s again, exiting without waiting for requests in flight", sig)
+		os.Exit(1)
+	}()
+}
+
+// addSystemLogHooks logs to syslog and journald, if configured
+func (p *program) addSystemLogHooks() {
+	if p.Syslog.Enabled() {
+		hook, err := eventHook.NewSyslogHook(p.Syslog)
+		if err != nil {
+			log.Logger.Warnf("Could not connect to syslog: %s", err)
+		} else {
+			log.Logger.AddHook(hook)
+			log.Logger.Info("Logging to syslog enabled")
+		}
+	}
+	if p.Journald {
+		hook, err := eventHook.NewJournaldHook(p.Syslog.Tag)
+		if err != nil {
+			log.Logger.Warnf("Could not connect to journald: %s", err)
+		} else {
+			log.Logger.AddHook(hook)
+			log.Logger.Info("Logging to journald enabled")
+		}
+	}
+}
+
+// reloadOnSignal reloads the config on SIGHUP, until ctx is done
+func reloadOnSignal(ctx context.Context, reloader *Reloader) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+		}
+
+		log.Logger.Info("Received SIGHUP, reloading config")
+		err := reloader.Reload()
+		if err != nil {
+			log.Logger.Errorf("Config not reloaded: %s", err)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+// +build windows
+
+package tipservice
+
+import (
+	"context"
+
+	"github.com/kardianos/service"
+	"github.com/tktip/flyvo-rpc-client/internal/log"
+	"github.com/tktip/flyvo-rpc-client/pkg/eventHook"
+)
+
+const serviceName = "Tip Flyvo Service"
+
+var serviceDependencies []string
+
+func serviceOptions() service.KeyValue {
+	return service.KeyValue{}
+}
+
+// addSystemLogHooks logs to the event log, unless disabled
+func (p *program) addSystemLogHooks() {
+	if !p.NoEventLog && logger != nil {
+		log.Logger.Info("Event log not disabled, adding event logger hook")
+		hook := eventHook.NewHook(logger)
+		log.Logger.AddHook(hook)
+	}
+}
+
+// reloadOnSignal does nothing, as Windows has no SIGHUP. Use POST /admin/reload
+// or watchConfig instead.
+func reloadOnSignal(ctx context.Context, reloader *Reloader) {}
@@ -0,0 +1,252 @@
+package tipservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tktip/flyvo-rpc-client/internal/api"
+	"github.com/tktip/flyvo-rpc-client/internal/log"
+	"github.com/tktip/flyvo-rpc-client/internal/secret"
+)
+
+// ErrorRestartRequired - the new config changes settings that are only read at startup
+var ErrorRestartRequired = errors.New("restart needed to change")
+
+// reloadable - yaml paths of the settings that can change while running.
+// Anything below them is reloadable too.
+var reloadable = []string{
+	"logLevel",
+	"api.timeout",
+	"api.rpc.flyvo",
+	"api.rpc.pollFrequency",
+	"api.rpc.connFailSleep",
+	"api.rpc.backoff",
+	"api.rpc.connTimeout",
+}
+
+// Reloader re-reads the config and applies the settings that can change while
+// running. Changes to anything else are rejected, as they need a restart.
+type Reloader struct {
+	source string
+	srv    *api.Server
+
+	lock     sync.Mutex
+	current  *Config
+	modified time.Time
+}
+
+// NewReloader reads the config the running api server was started with, to
+// compare reloads against
+func NewReloader(source string, srv *api.Server) (*Reloader, error) {
+	r := &Reloader{source: source, srv: srv}
+	conf, modified, _, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	r.current = conf
+	r.modified = modified
+	return r, nil
+}
+
+// Reload reads and validates the config, and applies it if only reloadable
+// settings have changed. Requests in flight finish with the old settings.
+func (r *Reloader) Reload() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	next, modified, warnings, err := r.load()
+	// Not retried by Watch until the file changes again, even if rejected
+	if !modified.IsZero() {
+		r.modified = modified
+	}
+	if err != nil {
+		return err
+	}
+	for _, warning := range warnings {
+		log.Logger.Warnf("Config: %s (ignored)", warning)
+	}
+
+	changed := r.current.changes(next)
+	restart := []string{}
+	for _, setting := range changed {
+		if !isReloadable(setting) {
+			restart = append(restart, setting)
+		}
+	}
+	if len(restart) > 0 {
+		return fmt.Errorf("%w: %s", ErrorRestartRequired, strings.Join(restart, ", "))
+	}
+	if len(changed) == 0 {
+		log.Logger.Info("Config unchanged, nothing to reload")
+		return nil
+	}
+
+	level, _ := next.Level()
+	log.Logger.SetLevel(level)
+	r.srv.Reload(&next.Api)
+	r.current = next
+	log.Logger.Infof("Config reloaded, changed %s", strings.Join(changed, ", "))
+	return nil
+}
+
+// Watch reloads the config whenever the file changes, until ctx is done.
+// If a reload fails, the running config is kept.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	file := configPath(r.source)
+	if file == "" {
+		log.Logger.Warnf("Config source '%s' is not a file, not watching it", r.source)
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		r.lock.Lock()
+		changed := !info.ModTime().Equal(r.modified)
+		r.lock.Unlock()
+		if !changed {
+			continue
+		}
+
+		log.Logger.Infof("Config file %s changed, reloading", file)
+		err = r.Reload()
+		if err != nil {
+			log.Logger.Errorf("Config not reloaded: %s", err)
+		}
+	}
+}
+
+func (r *Reloader) load() (*Config, time.Time, []string, error) {
+	var modified time.Time
+	if file := configPath(r.source); file != "" {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, modified, nil, err
+		}
+		modified = info.ModTime()
+	}
+
+	conf, warnings, err := LoadWarn(r.source)
+	return conf, modified, warnings, err
+}
+
+// configPath resolves the file a cfger source reads from, or "" if it is not
+// a file
+func configPath(source string) string {
+	parts := strings.SplitN(source, "::", 2)
+	if len(parts) < 2 {
+		return ""
+	}
+	switch parts[0] {
+	case "file":
+		return parts[1]
+	case "secret":
+		return path.Join("/run/secrets", parts[1])
+	case "env":
+		return configPath(os.Getenv(parts[1]))
+	}
+	return ""
+}
+
+func isReloadable(setting string) bool {
+	for _, prefix := range reloadable {
+		if setting == prefix || strings.HasPrefix(setting, prefix+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// changes lists the yaml paths of the settings that differ in next. Secrets
+// are compared by the reference they were given as, if any, as they are only
+// resolved at startup.
+func (c *Config) changes(next *Config) []string {
+	d := differ{a: c.references, b: next.references}
+	return d.changes("", reflect.ValueOf(c), reflect.ValueOf(next))
+}
+
+// differ - compares two configs, with the secret references of each
+type differ struct {
+	a, b map[string]secret.Secret
+}
+
+// secretSetting returns a secret as it was given in the config
+func secretSetting(path string, v reflect.Value, references map[string]secret.Secret) secret.Secret {
+	if reference, ok := references[path]; ok {
+		return reference
+	}
+	return v.Interface().(secret.Secret)
+}
+
+func (d differ) changes(prefix string, a, b reflect.Value) []string {
+	if a.Type() == secretType {
+		if secretSetting(prefix, a, d.a) != secretSetting(prefix, b, d.b) {
+			return []string{prefix}
+		}
+		return nil
+	}
+
+	switch a.Kind() {
+	case reflect.Ptr:
+		if a.IsNil() || b.IsNil() {
+			if a.IsNil() != b.IsNil() {
+				return []string{prefix}
+			}
+			return nil
+		}
+		return d.changes(prefix, a.Elem(), b.Elem())
+	case reflect.Struct:
+		changed := []string{}
+		for i := 0; i < a.NumField(); i++ {
+			name, ok := settingName(a.Type().Field(i))
+			if ok {
+				changed = append(changed, d.changes(joinPath(prefix, name), a.Field(i), b.Field(i))...)
+			}
+		}
+		return changed
+	case reflect.Map:
+		if a.Type().Elem() != secretType {
+			break
+		}
+		if a.Len() != b.Len() {
+			return []string{prefix}
+		}
+		for _, key := range a.MapKeys() {
+			path := joinPath(prefix, key.String())
+			other := b.MapIndex(key)
+			if !other.IsValid() || secretSetting(path, a.MapIndex(key), d.a) != secretSetting(path, other, d.b) {
+				return []string{prefix}
+			}
+		}
+		return nil
+	}
+
+	if !reflect.DeepEqual(a.Interface(), b.Interface()) {
+		return []string{prefix}
+	}
+	return nil
+}
+
+func joinPath(prefix, name string) string {
+	if prefix == "" || name == "" {
+		return prefix + name
+	}
+	return prefix + "." + name
+}
@@ -0,0 +1,50 @@
+package tipservice
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReloadSecretReferences(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key := filepath.Join(dir, "key")
+	other := filepath.Join(dir, "other")
+	ioutil.WriteFile(key, []byte("first"), 0600)
+	ioutil.WriteFile(other, []byte("other"), 0600)
+
+	withKey := func(file string) string {
+		return validConfig + `
+    auth:
+      type: apiKey
+      apiKey: file::` + file + `
+      allowInsecure: true
+`
+	}
+	source, cleanup := writeConfig(t, withKey(key))
+	defer cleanup()
+	r, err := NewReloader(source, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the file the reference points to changed, but the config did not
+	ioutil.WriteFile(key, []byte("rotated"), 0600)
+	if err := r.Reload(); err != nil {
+		t.Errorf("same reference: got %v, want the config unchanged", err)
+	}
+
+	file := strings.TrimPrefix(source, "file::")
+	ioutil.WriteFile(file, []byte(withKey(other)), 0600)
+	err = r.Reload()
+	if !errors.Is(err, ErrorRestartRequired) || !strings.Contains(err.Error(), "api.rpc.auth.apiKey") {
+		t.Errorf("new reference: got %v, want a restart required for api.rpc.auth.apiKey", err)
+	}
+}
@@ -0,0 +1,65 @@
+package tipservice
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/tktip/flyvo-rpc-client/internal/secret"
+)
+
+var secretType = reflect.TypeOf(secret.Secret(""))
+
+// resolveSecrets replaces every secret given as a reference, e.g.
+// file::/run/keys/api-key, by the value it points to. The references are kept
+// by path, so reloads can compare what the config says.
+func (c *Config) resolveSecrets() problems {
+	found := problems{}
+	c.references = map[string]secret.Secret{}
+	resolveSecrets("", reflect.ValueOf(c).Elem(), &found, c.references)
+	return found
+}
+
+func resolveSecrets(path string, v reflect.Value, found *problems, references map[string]secret.Secret) {
+	if v.Type() == secretType {
+		reference := v.Interface().(secret.Secret)
+		if reference.IsReference() {
+			references[path] = reference
+		}
+		resolved, err := reference.Resolve()
+		if err != nil {
+			found.add(path, "%s", err)
+		}
+		// Never left as the reference, if it could not be resolved
+		v.Set(reflect.ValueOf(resolved))
+		return
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			resolveSecrets(path, v.Elem(), found, references)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			name, ok := settingName(v.Type().Field(i))
+			if ok {
+				resolveSecrets(joinPath(path, name), v.Field(i), found, references)
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			resolveSecrets(fmt.Sprintf("%s[%d]", path, i), v.Index(i), found, references)
+		}
+	case reflect.Map:
+		if v.Type().Elem() != secretType {
+			return
+		}
+		for _, key := range v.MapKeys() {
+			// Map values can't be set in place
+			value := reflect.New(secretType).Elem()
+			value.Set(v.MapIndex(key))
+			resolveSecrets(joinPath(path, key.String()), value, found, references)
+			v.SetMapIndex(key, value)
+		}
+	}
+}
@@ -1,5 +1,3 @@
-// +build windows
-
 package tipservice
 
 import (
@@ -12,30 +10,36 @@ var (
 	done   chan int
 )
 
-func New(args []string) service.Service {
-	if len(args) < 2 {
-		log.Logger.Fatal("Missing args! Please create service with 'configFile=[path]' set.")
+// New creates the service, which runs with the config from source and the
+// settings given as flags. Source may be empty for controlling an installed
+// service, e.g. to start or stop it, or if every setting is given as a flag.
+func New(source string) (service.Service, error) {
+	args := []string{"run"}
+	if source != "" {
+		args = append(args, "--config", source)
 	}
-
 	svcConfig := &service.Config{
-		Name:        "Tip Flyvo Service",
-		DisplayName: "Tip Flyvo",
-		Description: "Service that communicates with TIP via RPC, functioning as a 'proxy' between FLYVO and TIP",
+		Name:         serviceName,
+		DisplayName:  "Tip Flyvo",
+		Description:  "Service that communicates with TIP via RPC, functioning as a 'proxy' between FLYVO and TIP",
+		Arguments:    append(args, FlagArgs()...),
+		Dependencies: serviceDependencies,
+		Option:       serviceOptions(),
 	}
 
 	prg := &program{
-		args: args,
+		source: source,
 	}
 
 	tipService, err := service.New(prg, svcConfig)
 	if err != nil {
-		log.Logger.Fatal(err)
+		return nil, err
 	}
 
 	//init loggers
 	logger, err = tipService.Logger(nil)
 	if err != nil {
-		log.Logger.Fatal(err)
+		log.Logger.Warnf("Could not open the system logger: %s", err)
 	}
-	return tipService
+	return tipService, nil
 }
@@ -0,0 +1,446 @@
+package tipservice
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tktip/cfger"
+	"github.com/tktip/flyvo-rpc-client/internal/log"
+	"github.com/tktip/flyvo-rpc-client/internal/rpc"
+	"github.com/tktip/flyvo-rpc-client/internal/tlsconfig"
+)
+
+// ValidationError lists every problem found in a config
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid config: %s", strings.Join(e.Problems, "; "))
+}
+
+// problems collects what is wrong with a config, so all of it is reported at once
+type problems []string
+
+func (p *problems) add(setting string, format string, args ...interface{}) {
+	*p = append(*p, setting+": "+fmt.Sprintf(format, args...))
+}
+
+func (p problems) err() error {
+	if len(p) == 0 {
+		return nil
+	}
+	return &ValidationError{Problems: p}
+}
+
+// LoadValid loads the config, failing with every problem found if it has keys
+// or environment variables that match no setting, or invalid values
+func LoadValid(source string) (*Config, error) {
+	conf, unknown, err := LoadWarn(source)
+	if conf == nil {
+		return nil, err
+	}
+	found := problems{}
+	if verr, ok := err.(*ValidationError); ok {
+		found = append(found, verr.Problems...)
+	}
+	found = append(found, unknown...)
+	return conf, found.err()
+}
+
+// LoadWarn loads the config, failing with every problem found if it has
+// invalid values. Keys and environment variables that match no setting are
+// returned as warnings instead, so an old or misspelled key does not stop the
+// service. The config is nil if it could not be read.
+func LoadWarn(source string) (*Config, []string, error) {
+	found := problems{}
+	conf, err := Load(source)
+	if verr, ok := err.(*ValidationError); ok {
+		found = append(found, verr.Problems...)
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	unknown := problems{}
+	for _, name := range unknownEnv() {
+		unknown.add(name, "unknown setting")
+	}
+	raw := map[string]interface{}{}
+	if source != "" {
+		_, err = cfger.ReadStructuredCfg(source, &raw)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	asJSON := strings.HasSuffix(configPath(source), ".json")
+	keys := unknownKeys("", raw, reflect.TypeOf(conf), asJSON)
+	sort.Strings(keys)
+	for _, key := range keys {
+		unknown.add(key, "unknown setting")
+	}
+
+	found = append(found, conf.problems()...)
+	return conf, unknown, found.err()
+}
+
+// ValidateCommand checks the config from source, printing every problem found.
+// Returns the exit code, 0 if the config is valid.
+func ValidateCommand(w io.Writer, source string) int {
+	_, err := LoadValid(source)
+	if source == "" {
+		source = "Config from environment and flags"
+	}
+	if verr, ok := err.(*ValidationError); ok {
+		fmt.Fprintf(w, "%s has %d problem(s):\n", source, len(verr.Problems))
+		for _, problem := range verr.Problems {
+			fmt.Fprintf(w, "  %s\n", problem)
+		}
+		return 1
+	} else if err != nil {
+		fmt.Fprintf(w, "Could not read %s: %s\n", source, err)
+		return 1
+	}
+	fmt.Fprintf(w, "%s is valid\n", source)
+	return 0
+}
+
+// SourceFromArg turns a config argument into a cfger source. The argument
+// may be a path, configFile=path or a cfger source such as env::CONFIG.
+// Paths are made absolute, as services don't run in the current directory.
+func SourceFromArg(arg string) string {
+	arg = strings.TrimPrefix(arg, "configFile=")
+	if strings.Contains(arg, "::") {
+		return arg
+	}
+	if abs, err := filepath.Abs(arg); err == nil {
+		arg = abs
+	}
+	return "file::" + arg
+}
+
+// Validate checks every setting, failing with all problems found
+func (c *Config) Validate() error {
+	return c.problems().err()
+}
+
+func (c *Config) problems() problems {
+	p := problems{}
+
+	if _, err := c.Level(); err != nil {
+		p.add("logLevel", "%s", err)
+	}
+	switch c.LogFormat {
+	case "", log.FormatText, log.FormatJSON:
+	default:
+		p.add("logFormat", "must be text or json, not '%s'", c.LogFormat)
+	}
+	switch c.Redaction.Mode {
+	case "", log.RedactMask, log.RedactHash, log.RedactNone:
+	default:
+		p.add("logRedaction.mode", "must be mask, hash or none, not '%s'", c.Redaction.Mode)
+	}
+	if c.LogFile != "" {
+		p.directory("logFile", c.LogFile)
+	}
+	if c.Rotation.MaxSize < 0 {
+		p.add("logRotation.maxSize", "must not be negative")
+	}
+	p.positive("logRotation.maxAge", c.Rotation.MaxAge, false)
+	if c.Rotation.MaxBackups < 0 {
+		p.add("logRotation.maxBackups", "must not be negative")
+	}
+	switch c.Syslog.Network {
+	case "", "udp", "tcp", "unix":
+	default:
+		p.add("syslog.network", "must be udp, tcp or unix, not '%s'", c.Syslog.Network)
+	}
+	p.positive("watchConfig", c.WatchConfig, false)
+
+	srv := c.Api
+	port, err := strconv.Atoi(srv.Port)
+	if err != nil || port < 1 || port > 65535 {
+		p.add("api.port", "must be a port number (1-65535), not '%s'", srv.Port)
+	}
+	p.tls("api.tls", srv.TLS)
+	if !srv.TLS.Empty() && srv.TLS.CertFile == "" {
+		p.add("api.tls.certFile", "is required when api.tls is set")
+	}
+	if srv.RequireCert && srv.TLS.CAFile == "" {
+		p.add("api.requireClientCert", "requires api.tls.caFile")
+	}
+	p.positive("api.timeout", srv.RequestTimeout, false)
+	p.positive("api.shutdownTimeout", srv.ShutdownTimeout, false)
+	p.address("api.health.address", srv.Health.Address)
+	p.positive("api.health.cacheTTL", srv.Health.CacheTTL, false)
+	p.positive("api.health.timeout", srv.Health.Timeout, false)
+	if srv.Outbox.Path != "" {
+		p.directory("api.outbox.path", srv.Outbox.Path)
+	}
+	p.positive("api.outbox.replayInterval", srv.Outbox.ReplayInterval, false)
+	if srv.Outbox.MaxAttempts < 0 {
+		p.add("api.outbox.maxAttempts", "must not be negative")
+	}
+	for i, cred := range srv.Auth.Credentials {
+		if err := cred.Validate(); err != nil {
+			p.add(fmt.Sprintf("api.auth.credentials[%d]", i), "%s", err)
+		}
+	}
+	p.positive("api.auth.maxClockSkew", srv.Auth.MaxClockSkew, false)
+	if srv.Auth.MaxBodySize < 0 {
+		p.add("api.auth.maxBodySize", "must not be negative")
+	}
+
+	if srv.RpcClient == nil {
+		p.add("api.rpc", "is required")
+	} else {
+		p.rpcClient(srv.RpcClient)
+	}
+
+	if c.Tracing.Endpoint != "" {
+		p.url("tracing.endpoint", c.Tracing.Endpoint)
+	}
+	if ratio := c.Tracing.SampleRatio; ratio != nil && (*ratio < 0 || *ratio > 1) {
+		p.add("tracing.sampleRatio", "must be between 0 and 1, not %v", *ratio)
+	}
+	p.positive("tracing.batchInterval", c.Tracing.BatchInterval, false)
+	return p
+}
+
+func (p *problems) rpcClient(c *rpc.Client) {
+	p.address("api.rpc.serverAddress", c.RpcServerAddress)
+	if c.RpcCertFile != "" {
+		p.file("api.rpc.certFile", c.RpcCertFile)
+	}
+	p.tls("api.rpc.tls", c.TLS)
+
+	if err := c.Auth.Validate(); err != nil {
+		p.add("api.rpc.auth", "%s", err)
+	} else if c.Auth.Type != "" && c.TLS.Empty() && c.RpcCertFile == "" && !c.Auth.AllowInsecure {
+		p.add("api.rpc.auth", "requires api.rpc.tls, or allowInsecure")
+	}
+	if c.Auth.Type == rpc.AuthTokenFile && c.Auth.TokenFile != "" {
+		p.file("api.rpc.auth.tokenFile", c.Auth.TokenFile)
+	}
+
+	if c.FlyvoApiEndpoints.RootAddress == "" {
+		p.add("api.rpc.flyvo.address", "is required")
+	} else {
+		p.url("api.rpc.flyvo.address", c.FlyvoApiEndpoints.RootAddress)
+	}
+	for _, legacy := range c.FlyvoApiEndpoints.LegacyPaths() {
+		if !strings.HasPrefix(legacy.Path, "/") {
+			p.add("api.rpc.flyvo."+legacy.Setting, "must start with /, not '%s'", legacy.Path)
+		}
+	}
+	paths := []string{}
+	for path := range c.FlyvoApiEndpoints.Routes {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		route := c.FlyvoApiEndpoints.Routes[path]
+		setting := "api.rpc.flyvo.routes." + path
+		if route.Path != "" && !strings.HasPrefix(route.Path, "/") {
+			p.add(setting+".path", "must start with /, not '%s'", route.Path)
+		}
+		switch strings.ToUpper(route.Method) {
+		case "", http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		default:
+			p.add(setting+".method", "unknown method '%s'", route.Method)
+		}
+		switch route.Body {
+		case "", rpc.BodyForward, rpc.BodyNone:
+		default:
+			p.add(setting+".body", "must be forward or none, not '%s'", route.Body)
+		}
+	}
+
+	switch c.StreamMode {
+	case "", rpc.StreamModePoll, rpc.StreamModePersistent:
+	default:
+		p.add("api.rpc.streamMode", "must be poll or persistent, not '%s'", c.StreamMode)
+	}
+	p.positive("api.rpc.pollFrequency", c.PollFrequency, false)
+	p.positive("api.rpc.connFailSleep", c.BadConnectSleep, false)
+	if c.ConnTimeout != nil {
+		p.positive("api.rpc.connTimeout", *c.ConnTimeout, true)
+	}
+	p.positive("api.rpc.backoff.initial", c.Backoff.Initial, false)
+	p.positive("api.rpc.backoff.max", c.Backoff.Max, false)
+	if c.Backoff.Multiplier != 0 && c.Backoff.Multiplier < 1 {
+		p.add("api.rpc.backoff.multiplier", "must be at least 1, not %v", c.Backoff.Multiplier)
+	}
+	if jitter := c.Backoff.Jitter; jitter != nil && (*jitter < 0 || *jitter > 1) {
+		p.add("api.rpc.backoff.jitter", "must be between 0 and 1, not %v", *jitter)
+	}
+	if c.Backoff.UnaryRetries != nil && *c.Backoff.UnaryRetries < 0 {
+		p.add("api.rpc.backoff.unaryRetries", "must not be negative")
+	}
+	if c.MaxInFlight < 0 {
+		p.add("api.rpc.maxInFlight", "must not be negative")
+	}
+	p.positive("api.rpc.keepalive.time", c.Keepalive.Time, false)
+	p.positive("api.rpc.keepalive.timeout", c.Keepalive.Timeout, false)
+	p.positive("api.rpc.healthCheck.timeout", c.HealthCheck.Timeout, false)
+}
+
+// positive reports negative values, and zero if required
+func (p *problems) positive(setting string, d time.Duration, required bool) {
+	if d < 0 {
+		p.add(setting, "must not be negative")
+	} else if d == 0 && required {
+		p.add(setting, "must be set")
+	}
+}
+
+// address reports addresses that are not host:port with a valid port
+func (p *problems) address(setting, address string) {
+	if address == "" {
+		return
+	}
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		p.add(setting, "%s", err)
+		return
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		p.add(setting, "port must be 1-65535, not '%s'", port)
+	}
+}
+
+// url reports urls that are not absolute http(s) urls
+func (p *problems) url(setting, address string) {
+	u, err := url.Parse(address)
+	if err != nil {
+		p.add(setting, "%s", err)
+	} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		p.add(setting, "must be an absolute http(s) url, not '%s'", address)
+	}
+}
+
+func (p *problems) file(setting, path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		p.add(setting, "%s", err)
+	} else if info.IsDir() {
+		p.add(setting, "%s is a directory", path)
+	}
+}
+
+// directory reports files whose directory does not exist
+func (p *problems) directory(setting, path string) {
+	dir := filepath.Dir(path)
+	info, err := os.Stat(dir)
+	if err != nil {
+		p.add(setting, "%s", err)
+	} else if !info.IsDir() {
+		p.add(setting, "%s is not a directory", dir)
+	}
+}
+
+// tls reports certificate files that can't be loaded
+func (p *problems) tls(setting string, files tlsconfig.Files) {
+	if files.Empty() {
+		return
+	}
+	_, err := tlsconfig.NewReloader(files)
+	if err != nil {
+		p.add(setting, "%s", err)
+	}
+	p.positive(setting+".reloadInterval", files.ReloadInterval, false)
+}
+
+// unknownKeys lists the keys in raw that match no field of t. Keys are
+// matched like yaml.v3 does, or like encoding/json if asJSON is set.
+func unknownKeys(prefix string, raw interface{}, t reflect.Type, asJSON bool) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	unknown := []string{}
+	switch t.Kind() {
+	case reflect.Struct:
+		values, ok := raw.(map[string]interface{})
+		if !ok || t == reflect.TypeOf(time.Time{}) {
+			return nil
+		}
+		for key, value := range values {
+			field, ok := findField(t, key, asJSON)
+			if !ok {
+				unknown = append(unknown, joinPath(prefix, key))
+				continue
+			}
+			unknown = append(unknown, unknownKeys(joinPath(prefix, key), value, field.Type, asJSON)...)
+		}
+	case reflect.Map:
+		values, ok := raw.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		for key, value := range values {
+			unknown = append(unknown, unknownKeys(joinPath(prefix, key), value, t.Elem(), asJSON)...)
+		}
+	case reflect.Slice:
+		values, ok := raw.([]interface{})
+		if !ok {
+			return nil
+		}
+		for i, value := range values {
+			setting := fmt.Sprintf("%s[%d]", prefix, i)
+			unknown = append(unknown, unknownKeys(setting, value, t.Elem(), asJSON)...)
+		}
+	}
+	return unknown
+}
+
+// findField finds the field of struct t that key is decoded into
+func findField(t reflect.Type, key string, asJSON bool) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		if asJSON {
+			name := strings.Split(field.Tag.Get("json"), ",")[0]
+			if name == "-" {
+				continue
+			} else if name == "" {
+				name = field.Name
+			}
+			if strings.EqualFold(name, key) {
+				return field, true
+			}
+			continue
+		}
+
+		tag := strings.Split(field.Tag.Get("yaml"), ",")
+		if tag[0] == "-" {
+			continue
+		} else if tag[0] == "" && len(tag) > 1 && tag[1] == "inline" {
+			if inlined, ok := findField(field.Type, key, asJSON); ok {
+				return inlined, true
+			}
+			continue
+		}
+		name := tag[0]
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		if name == key {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
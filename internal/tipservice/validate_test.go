@@ -0,0 +1,173 @@
+package tipservice
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const validConfig = `
+api:
+  port: 8080
+  rpc:
+    serverAddress: tip:50051
+    flyvo:
+      address: http://flyvo
+`
+
+// writeConfig writes a config file, returning its source and a cleanup func
+func writeConfig(t *testing.T, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "cfg.yml")
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return "file::" + file, func() { os.RemoveAll(dir) }
+}
+
+func TestLoadValid(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		env    map[string]string
+		want   []string
+	}{
+		{"valid", validConfig, nil, nil},
+		{"invalid values", `
+logLevel: loud
+logFormat: xml
+logRedaction:
+  mode: scramble
+watchConfig: -1s
+api:
+  port: 99999
+  timeout: -1s
+  requireClientCert: true
+  outbox:
+    maxAttempts: -1
+  auth:
+    credentials:
+      - name: x
+        type: apiKey
+  rpc:
+    serverAddress: tip
+    streamMode: sometimes
+    flyvo:
+      address: flyvo
+      routes:
+        x:
+          method: FETCH
+tracing:
+  endpoint: not a url
+  sampleRatio: 2
+`, nil, []string{
+			`logLevel: not a valid logrus Level: "loud"`,
+			"logFormat: must be text or json, not 'xml'",
+			"logRedaction.mode: must be mask, hash or none, not 'scramble'",
+			"watchConfig: must not be negative",
+			"api.port: must be a port number (1-65535), not '99999'",
+			"api.requireClientCert: requires api.tls.caFile",
+			"api.timeout: must not be negative",
+			"api.outbox.maxAttempts: must not be negative",
+			"api.auth.credentials[0]: type apiKey requires key",
+			"api.rpc.serverAddress: address tip: missing port in address",
+			"api.rpc.flyvo.address: must be an absolute http(s) url, not 'flyvo'",
+			"api.rpc.flyvo.routes.x.method: unknown method 'FETCH'",
+			"api.rpc.streamMode: must be poll or persistent, not 'sometimes'",
+			"tracing.endpoint: must be an absolute http(s) url, not 'not a url'",
+			"tracing.sampleRatio: must be between 0 and 1, not 2",
+		}},
+		{"unknown keys", `
+logLevl: debug
+api:
+  port: 8080
+  prot: 1
+  rpc:
+    serverAddress: tip:50051
+    flyvo:
+      address: http://flyvo
+`, nil, []string{
+			"api.prot: unknown setting",
+			"logLevl: unknown setting",
+		}},
+		{"legacy flyvo paths", validConfig + `
+      pathConvertAbsence: /flyvo/convertAbsence
+      pathGetSickLeaves: flyvo/sickleave
+`, nil, []string{
+			"api.rpc.flyvo.pathGetSickLeaves: must start with /, not 'flyvo/sickleave'",
+		}},
+		{"environment", validConfig, map[string]string{
+			"FLYVO_RPC_BOGUS":           "1",
+			"FLYVO_RPC_API_RPC_BACKOFF": "x",
+			"FLYVO_RPC_WATCHCONFIG":     "soon",
+		}, []string{
+			`FLYVO_RPC_WATCHCONFIG: time: invalid duration "soon"`,
+			"FLYVO_RPC_API_RPC_BACKOFF: unknown setting",
+			"FLYVO_RPC_BOGUS: unknown setting",
+		}},
+		{"unresolved secret", validConfig + `
+    auth:
+      type: apiKey
+      apiKey: env::FLYVO_TEST_MISSING
+      allowInsecure: true
+`, nil, []string{
+			"api.rpc.auth.apiKey: env: environment variable FLYVO_TEST_MISSING is not set",
+			"api.rpc.auth: auth type apiKey requires apiKey",
+		}},
+	}
+
+	for _, test := range tests {
+		source, cleanup := writeConfig(t, test.config)
+		for name, value := range test.env {
+			os.Setenv(name, value)
+		}
+
+		_, err := LoadValid(source)
+		var got []string
+		if verr, ok := err.(*ValidationError); ok {
+			got = verr.Problems
+		} else if err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got problems\n%q\nwant\n%q", test.name, got, test.want)
+		}
+
+		for name := range test.env {
+			os.Unsetenv(name)
+		}
+		cleanup()
+	}
+}
+
+func TestLoadWarn(t *testing.T) {
+	source, cleanup := writeConfig(t, validConfig+"      pathConvertAbsnce: /x\nlogLevl: debug\n")
+	defer cleanup()
+
+	conf, warnings, err := LoadWarn(source)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if conf.Api.RpcClient.FlyvoApiEndpoints.RootAddress != "http://flyvo" {
+		t.Errorf("got flyvo address %q, want the config loaded", conf.Api.RpcClient.FlyvoApiEndpoints.RootAddress)
+	}
+	want := []string{
+		"api.rpc.flyvo.pathConvertAbsnce: unknown setting",
+		"logLevl: unknown setting",
+	}
+	if !reflect.DeepEqual(warnings, want) {
+		t.Errorf("got warnings %q, want %q", warnings, want)
+	}
+
+	source, cleanup = writeConfig(t, validConfig+"logLevel: loud\n")
+	defer cleanup()
+	_, _, err = LoadWarn(source)
+	if _, ok := err.(*ValidationError); !ok {
+		t.Errorf("got %v for an invalid value, want a ValidationError", err)
+	}
+}
@@ -0,0 +1,342 @@
+// Package tlsconfig builds TLS configs from certificate files, and reloads the
+// files when they change so certificates can be replaced without a restart.
+package tlsconfig
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tktip/flyvo-rpc-client/internal/log"
+	"github.com/tktip/flyvo-rpc-client/internal/secret"
+)
+
+const defaultReloadInterval = time.Minute
+
+var (
+	// ErrorNoCertificates - no certificates were found in a CA file
+	ErrorNoCertificates = errors.New("no certificates found in CA file")
+	// ErrorBadMinVersion - minVersion is not one of the supported TLS versions
+	ErrorBadMinVersion = errors.New("unknown TLS version, use one of 1.0, 1.1, 1.2 or 1.3")
+	// ErrorNoKey - no private key was found in a key file
+	ErrorNoKey = errors.New("no private key found in key file")
+
+	versions = map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+)
+
+// Files - certificate files and settings for one end of a TLS connection
+type Files struct {
+	// CertFile and KeyFile is our own certificate/key pair
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+	// KeyPassphrase decrypts KeyFile if it uses the legacy PEM encryption.
+	// Deprecated: keep KeyFile unencrypted and readable only by the service.
+	KeyPassphrase secret.Secret `yaml:"keyPassphrase"`
+	// CAFile is a bundle of CA certificates the other end is verified against
+	CAFile string `yaml:"caFile"`
+	// ServerName overrides the name the server certificate is verified for
+	ServerName string `yaml:"serverName"`
+	// MinVersion is the lowest TLS version accepted, 1.2 by default
+	MinVersion string `yaml:"minVersion"`
+	// ReloadInterval is how often the files are checked for changes
+	ReloadInterval time.Duration `yaml:"reloadInterval"`
+}
+
+// Empty returns true if no TLS settings are provided
+func (f Files) Empty() bool {
+	return f == Files{}
+}
+
+func (f Files) minVersion() (uint16, error) {
+	if f.MinVersion == "" {
+		return tls.VersionTLS12, nil
+	}
+	version, ok := versions[f.MinVersion]
+	if !ok {
+		return 0, fmt.Errorf("%w: '%s'", ErrorBadMinVersion, f.MinVersion)
+	}
+	return version, nil
+}
+
+// Reloader holds the certificates loaded from a set of Files, and reloads
+// them when the files change.
+type Reloader struct {
+	files      Files
+	minVersion uint16
+
+	lock     sync.RWMutex
+	cert     *tls.Certificate
+	pool     *x509.CertPool
+	modified map[string]time.Time
+}
+
+// NewReloader loads the certificate files, failing if any of them can't be used
+func NewReloader(files Files) (*Reloader, error) {
+	minVersion, err := files.minVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	if (files.CertFile == "") != (files.KeyFile == "") {
+		return nil, errors.New("certFile and keyFile must be set together")
+	}
+
+	r := &Reloader{files: files, minVersion: minVersion}
+	err = r.load()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Watch reloads the files whenever they change, until ctx is done.
+// If a reload fails, the previously loaded certificates are kept.
+func (r *Reloader) Watch(ctx context.Context) {
+	interval := r.files.ReloadInterval
+	if interval <= 0 {
+		interval = defaultReloadInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if !r.changed() {
+			continue
+		}
+
+		err := r.load()
+		if err != nil {
+			log.Logger.Errorf("Failed to reload TLS certificates, keeping the old ones: %s", err)
+			continue
+		}
+		log.Logger.Info("Reloaded TLS certificates")
+	}
+}
+
+// changed returns true if any of the files have been modified since last load
+func (r *Reloader) changed() bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	for _, file := range r.paths() {
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		if !info.ModTime().Equal(r.modified[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Reloader) paths() []string {
+	paths := []string{}
+	for _, file := range []string{r.files.CertFile, r.files.KeyFile, r.files.CAFile} {
+		if file != "" {
+			paths = append(paths, file)
+		}
+	}
+	return paths
+}
+
+func (r *Reloader) load() error {
+	modified := map[string]time.Time{}
+	for _, file := range r.paths() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modified[file] = info.ModTime()
+	}
+
+	var cert *tls.Certificate
+	if r.files.CertFile != "" {
+		pair, err := r.keyPair()
+		if err != nil {
+			return err
+		}
+		cert = &pair
+	}
+
+	var pool *x509.CertPool
+	if r.files.CAFile != "" {
+		pem, err := ioutil.ReadFile(r.files.CAFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("%w: %s", ErrorNoCertificates, r.files.CAFile)
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.cert = cert
+	r.pool = pool
+	r.modified = modified
+	return nil
+}
+
+// keyPair loads the certificate and key. Keys encrypted by OpenSSL's
+// traditional PEM encryption (e.g. openssl rsa -aes256) are still decrypted
+// with KeyPassphrase, with a warning, as that encryption is unauthenticated.
+// Keys should instead be unencrypted and readable only by the service account.
+func (r *Reloader) keyPair() (tls.Certificate, error) {
+	certPEM, err := ioutil.ReadFile(r.files.CertFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := ioutil.ReadFile(r.files.KeyFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return tls.Certificate{}, fmt.Errorf("%w: %s", ErrorNoKey, r.files.KeyFile)
+	}
+	if x509.IsEncryptedPEMBlock(block) {
+		if r.files.KeyPassphrase == "" {
+			return tls.Certificate{}, fmt.Errorf("%s is encrypted, but keyPassphrase is not set", r.files.KeyFile)
+		}
+		log.Logger.Warnf("%s uses the deprecated PEM encryption, decrypt it and make it readable "+
+			"only by the service account instead of setting keyPassphrase", r.files.KeyFile)
+		der, err := x509.DecryptPEMBlock(block, []byte(r.files.KeyPassphrase.Value()))
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("could not decrypt %s: %w", r.files.KeyFile, err)
+		}
+		keyPEM = pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der})
+	} else if block.Type == "ENCRYPTED PRIVATE KEY" {
+		return tls.Certificate{}, fmt.Errorf("%s is PKCS#8 encrypted, which is not supported. "+
+			"Decrypt it (openssl pkey) and make it readable only by the service account", r.files.KeyFile)
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+func (r *Reloader) certificate() *tls.Certificate {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.cert
+}
+
+func (r *Reloader) caPool() *x509.CertPool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.pool
+}
+
+// ClientConfig returns a TLS config for connecting to serverName, presenting
+// the current client certificate (if any) and verifying the server against
+// the current CA bundle (or the system roots if no CA file is set).
+func (r *Reloader) ClientConfig(serverName string) *tls.Config {
+	if r.files.ServerName != "" {
+		serverName = r.files.ServerName
+	}
+
+	cfg := &tls.Config{
+		ServerName: serverName,
+		MinVersion: r.minVersion,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert := r.certificate()
+			if cert == nil {
+				return &tls.Certificate{}, nil
+			}
+			return cert, nil
+		},
+	}
+
+	if r.files.CAFile != "" {
+		// The CA bundle may be reloaded, so verification is done against
+		// whatever pool is current at handshake time instead of a fixed RootCAs.
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyPeerCertificate = func(raw [][]byte, _ [][]*x509.Certificate) error {
+			return r.verify(raw, serverName, x509.ExtKeyUsageServerAuth)
+		}
+	}
+	return cfg
+}
+
+// verify checks a raw certificate chain against the current CA pool
+func (r *Reloader) verify(raw [][]byte, name string, usage x509.ExtKeyUsage) error {
+	if len(raw) == 0 {
+		return errors.New("no certificate presented")
+	}
+
+	certs := make([]*x509.Certificate, 0, len(raw))
+	for _, der := range raw {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       name,
+		Roots:         r.caPool(),
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	})
+	return err
+}
+
+// ServerConfig returns a TLS config for serving with the current certificate.
+// If a CA file is set, client certificates are verified against the current
+// CA bundle, and required if requireClientCert is set.
+func (r *Reloader) ServerConfig(requireClientCert bool) *tls.Config {
+	clientAuth := tls.NoClientCert
+	if r.files.CAFile != "" {
+		clientAuth = tls.VerifyClientCertIfGiven
+		if requireClientCert {
+			clientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	getCertificate := func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert := r.certificate()
+		if cert == nil {
+			return nil, errors.New("no server certificate loaded")
+		}
+		return cert, nil
+	}
+
+	return &tls.Config{
+		MinVersion:     r.minVersion,
+		GetCertificate: getCertificate,
+		// A new config is handed out per handshake so the client CA bundle
+		// can be reloaded.
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return &tls.Config{
+				MinVersion:     r.minVersion,
+				GetCertificate: getCertificate,
+				ClientAuth:     clientAuth,
+				ClientCAs:      r.caPool(),
+			}, nil
+		},
+	}
+}
@@ -0,0 +1,289 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tktip/flyvo-rpc-client/internal/log"
+	"github.com/tktip/flyvo-rpc-client/internal/version"
+)
+
+const (
+	defaultServiceName   = "flyvo-rpc-client"
+	defaultBatchInterval = 5 * time.Second
+	maxBatch             = 512
+	maxBuffered          = 8192
+)
+
+// otlpExporter buffers ended spans and posts them to the collector in batches
+type otlpExporter struct {
+	cfg        Config
+	httpClient *http.Client
+	random     *rand.Rand
+
+	lock    sync.Mutex
+	spans   []otlpSpan
+	dropped int
+
+	flush chan struct{}
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+func newExporter(cfg Config) *otlpExporter {
+	if cfg.ServiceName == "" {
+		cfg.ServiceName = defaultServiceName
+	}
+	if cfg.BatchInterval <= 0 {
+		cfg.BatchInterval = defaultBatchInterval
+	}
+
+	e := &otlpExporter{
+		cfg:        cfg,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		random:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		flush:      make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	e.wg.Add(1)
+	go e.run()
+	log.Logger.Infof("Exporting traces to %s", cfg.Endpoint)
+	return e
+}
+
+// sample decides whether a new trace is recorded
+func (e *otlpExporter) sample() bool {
+	if e.cfg.SampleRatio == nil || *e.cfg.SampleRatio >= 1 {
+		return true
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.random.Float64() < *e.cfg.SampleRatio
+}
+
+func (e *otlpExporter) add(s *Span, end time.Time) {
+	s.lock.Lock()
+	span := otlpSpan{
+		TraceID:    hex.EncodeToString(s.traceID[:]),
+		SpanID:     hex.EncodeToString(s.spanID[:]),
+		Name:       s.name,
+		Kind:       s.kind,
+		Start:      strconv.FormatInt(s.start.UnixNano(), 10),
+		End:        strconv.FormatInt(end.UnixNano(), 10),
+		Attributes: attributes(s.attributes),
+	}
+	if s.parentID != [8]byte{} {
+		span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	if s.err != nil {
+		span.Status = &otlpStatus{Code: 2, Message: s.err.Error()}
+	}
+	s.lock.Unlock()
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if len(e.spans) >= maxBuffered {
+		e.dropped++
+		return
+	}
+	e.spans = append(e.spans, span)
+	if len(e.spans) >= maxBatch {
+		select {
+		case e.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (e *otlpExporter) run() {
+	defer e.wg.Done()
+	ticker := time.NewTicker(e.cfg.BatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.done:
+			e.export()
+			return
+		case <-ticker.C:
+		case <-e.flush:
+		}
+		e.export()
+	}
+}
+
+// stop exports what is left, giving up when ctx is done
+func (e *otlpExporter) stop(ctx context.Context) {
+	close(e.done)
+	finished := make(chan struct{})
+	go func() {
+		e.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-ctx.Done():
+	}
+}
+
+func (e *otlpExporter) export() {
+	for {
+		e.lock.Lock()
+		batch := e.spans
+		if len(batch) > maxBatch {
+			batch = batch[:maxBatch]
+		}
+		e.spans = e.spans[len(batch):]
+		dropped := e.dropped
+		e.dropped = 0
+		e.lock.Unlock()
+
+		if dropped > 0 {
+			log.Logger.Warnf("Dropped %d spans, the trace exporter can't keep up", dropped)
+		}
+		if len(batch) == 0 {
+			return
+		}
+
+		err := e.post(batch)
+		if err != nil {
+			log.Logger.Warnf("Failed to export %d spans: %s", len(batch), err)
+			return
+		}
+	}
+}
+
+func (e *otlpExporter) post(batch []otlpSpan) error {
+	body, err := json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: attributes(map[string]interface{}{
+			"service.name":    e.cfg.ServiceName,
+			"service.version": version.VERSION,
+		})},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: defaultServiceName, Version: version.VERSION},
+			Spans: batch,
+		}},
+	}}})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.cfg.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range e.cfg.Headers {
+		req.Header.Set(key, value.Value())
+	}
+
+	resp, err := e.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// OTLP/JSON types, see opentelemetry-proto trace/v1/trace.proto
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	String *string  `json:"stringValue,omitempty"`
+	Int    *string  `json:"intValue,omitempty"`
+	Double *float64 `json:"doubleValue,omitempty"`
+	Bool   *bool    `json:"boolValue,omitempty"`
+}
+
+// attributes converts attribute values to OTLP, sorted by key
+func attributes(values map[string]interface{}) []otlpAttribute {
+	attrs := make([]otlpAttribute, 0, len(values))
+	for key, value := range values {
+		attr := otlpAttribute{Key: key}
+		switch v := value.(type) {
+		case string:
+			attr.Value.String = &v
+		case int:
+			i := strconv.Itoa(v)
+			attr.Value.Int = &i
+		case int32:
+			i := strconv.FormatInt(int64(v), 10)
+			attr.Value.Int = &i
+		case int64:
+			i := strconv.FormatInt(v, 10)
+			attr.Value.Int = &i
+		case float64:
+			attr.Value.Double = &v
+		case bool:
+			attr.Value.Bool = &v
+		default:
+			str := fmt.Sprint(v)
+			attr.Value.String = &str
+		}
+		attrs = append(attrs, attr)
+	}
+	sort.Slice(attrs, func(i, j int) bool {
+		return attrs[i].Key < attrs[j].Key
+	})
+	return attrs
+}
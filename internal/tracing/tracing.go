@@ -0,0 +1,249 @@
+// Package tracing records spans for requests passing through the client, and
+// exports them to an OpenTelemetry collector over OTLP/HTTP (JSON). Trace
+// context is propagated with W3C traceparent headers.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tktip/flyvo-rpc-client/internal/secret"
+)
+
+// Span kinds, as defined by OTLP
+const (
+	KindInternal = 1
+	KindServer   = 2
+	KindClient   = 3
+)
+
+// TraceparentHeader is the W3C trace context header (and Generic.Headers key)
+const TraceparentHeader = "traceparent"
+
+type spanKey struct{}
+
+// Config - where spans are exported to. Tracing is disabled if Endpoint is not set.
+type Config struct {
+	// Endpoint is the OTLP/HTTP traces url, e.g. http://collector:4318/v1/traces
+	Endpoint    string                   `yaml:"endpoint"`
+	Headers     map[string]secret.Secret `yaml:"headers"`
+	ServiceName string                   `yaml:"serviceName"`
+	// SampleRatio is the fraction of new traces that are recorded (default 1).
+	// Traces started by a caller follow the caller's decision.
+	SampleRatio   *float64      `yaml:"sampleRatio"`
+	BatchInterval time.Duration `yaml:"batchInterval"`
+}
+
+var (
+	exporterLock sync.RWMutex
+	exporter     *otlpExporter
+)
+
+// Setup starts exporting spans as configured. Does nothing if no endpoint is set.
+func Setup(cfg Config) {
+	if cfg.Endpoint == "" {
+		return
+	}
+
+	exporterLock.Lock()
+	defer exporterLock.Unlock()
+	if exporter != nil {
+		exporter.stop(context.Background())
+	}
+	exporter = newExporter(cfg)
+}
+
+// Shutdown exports any buffered spans and stops the exporter
+func Shutdown(ctx context.Context) {
+	exporterLock.Lock()
+	defer exporterLock.Unlock()
+	if exporter != nil {
+		exporter.stop(ctx)
+		exporter = nil
+	}
+}
+
+func current() *otlpExporter {
+	exporterLock.RLock()
+	defer exporterLock.RUnlock()
+	return exporter
+}
+
+// Span - one operation in a trace. A nil span is valid, and does nothing.
+type Span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	sampled  bool
+	remote   bool
+
+	name       string
+	kind       int
+	start      time.Time
+	lock       sync.Mutex
+	attributes map[string]interface{}
+	err        error
+	ended      bool
+}
+
+// Start starts a span as a child of the span in ctx (if any), returning a
+// context holding the new span. Returns ctx and a nil span if tracing is off.
+func Start(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	exp := current()
+	if exp == nil {
+		return ctx, nil
+	}
+
+	span := &Span{
+		name:       name,
+		kind:       kind,
+		start:      time.Now(),
+		attributes: map[string]interface{}{},
+	}
+
+	parent, ok := ctx.Value(spanKey{}).(*Span)
+	if ok && parent != nil {
+		span.traceID = parent.traceID
+		span.parentID = parent.spanID
+		span.sampled = parent.sampled
+	} else {
+		rand.Read(span.traceID[:])
+		span.sampled = exp.sample()
+	}
+	rand.Read(span.spanID[:])
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// FromContext returns the span in ctx, or nil if there is none. Spans
+// continued from a traceparent header are not returned, as they are recorded
+// by the caller.
+func FromContext(ctx context.Context) *Span {
+	span, ok := ctx.Value(spanKey{}).(*Span)
+	if !ok || span == nil || span.remote {
+		return nil
+	}
+	return span
+}
+
+// SetAttribute sets an attribute on the span
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	s.attributes[key] = value
+	s.lock.Unlock()
+}
+
+// SetError marks the span as failed
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.lock.Lock()
+	s.err = err
+	s.lock.Unlock()
+}
+
+// End ends the span and hands it to the exporter
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	if s.ended {
+		s.lock.Unlock()
+		return
+	}
+	s.ended = true
+	s.lock.Unlock()
+
+	exp := current()
+	if exp != nil && s.sampled {
+		exp.add(s, time.Now())
+	}
+}
+
+// Traceparent returns the W3C traceparent for the span in ctx, or "" if none
+func Traceparent(ctx context.Context) string {
+	span, ok := ctx.Value(spanKey{}).(*Span)
+	if !ok || span == nil {
+		return ""
+	}
+
+	flags := "00"
+	if span.sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s",
+		hex.EncodeToString(span.traceID[:]), hex.EncodeToString(span.spanID[:]), flags)
+}
+
+// Inject adds the traceparent of the span in ctx to a header map, such as
+// Generic.Headers. Returns the map, creating it if it is nil.
+func Inject(ctx context.Context, headers map[string]string) map[string]string {
+	traceparent := Traceparent(ctx)
+	if traceparent == "" {
+		return headers
+	}
+	if headers == nil {
+		headers = map[string]string{}
+	}
+	headers[TraceparentHeader] = traceparent
+	return headers
+}
+
+// Extract returns a context whose span continues the trace in traceparent,
+// so spans started from it become children of the remote span. Returns ctx
+// unchanged if traceparent is empty or malformed.
+func Extract(ctx context.Context, traceparent string) context.Context {
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 ||
+		len(parts[3]) != 2 {
+		return ctx
+	}
+	// version ff is invalid, and version 00 has exactly four fields. Later
+	// versions may add fields after the flags.
+	if parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return ctx
+	}
+
+	remote := &Span{remote: true, ended: true}
+	var version [1]byte
+	flags := make([]byte, 1)
+	if !decodeHex(version[:], parts[0]) || !decodeHex(remote.traceID[:], parts[1]) ||
+		!decodeHex(remote.spanID[:], parts[2]) || !decodeHex(flags, parts[3]) {
+		return ctx
+	}
+	if remote.traceID == [16]byte{} || remote.spanID == [8]byte{} {
+		return ctx
+	}
+	remote.sampled = flags[0]&1 == 1
+	return context.WithValue(ctx, spanKey{}, remote)
+}
+
+// decodeHex decodes lowercase hex into dst, as traceparent allows no uppercase
+func decodeHex(dst []byte, src string) bool {
+	if strings.ToLower(src) != src {
+		return false
+	}
+	_, err := hex.Decode(dst, []byte(src))
+	return err == nil
+}
+
+// Detach returns a background context carrying the span in ctx, for work that
+// must not be cancelled along with ctx but still belongs to its trace
+func Detach(ctx context.Context) context.Context {
+	span, ok := ctx.Value(spanKey{}).(*Span)
+	if !ok || span == nil {
+		return context.Background()
+	}
+	return context.WithValue(context.Background(), spanKey{}, span)
+}
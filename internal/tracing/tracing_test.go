@@ -0,0 +1,217 @@
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tktip/flyvo-rpc-client/internal/secret"
+)
+
+const (
+	traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	spanID  = "00f067aa0ba902b7"
+)
+
+// collector records the OTLP requests it receives
+type collector struct {
+	server   *httptest.Server
+	requests chan otlpRequest
+	headers  chan http.Header
+}
+
+func newCollector() *collector {
+	c := &collector{requests: make(chan otlpRequest, 10), headers: make(chan http.Header, 10)}
+	c.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		request := otlpRequest{}
+		json.Unmarshal(body, &request)
+		c.requests <- request
+		c.headers <- r.Header
+	}))
+	return c
+}
+
+// setup exports to a new collector until the returned func is called
+func setup(headers map[string]secret.Secret) (*collector, func()) {
+	c := newCollector()
+	Setup(Config{Endpoint: c.server.URL, Headers: headers, BatchInterval: time.Hour})
+	return c, func() {
+		Shutdown(context.Background())
+		c.server.Close()
+	}
+}
+
+func TestExtract(t *testing.T) {
+	tests := []struct {
+		name        string
+		traceparent string
+		valid       bool
+		sampled     bool
+	}{
+		{"sampled", "00-" + traceID + "-" + spanID + "-01", true, true},
+		{"not sampled", "00-" + traceID + "-" + spanID + "-00", true, false},
+		{"spaces", " 00-" + traceID + "-" + spanID + "-01 ", true, true},
+		{"later version with more fields", "01-" + traceID + "-" + spanID + "-01-extra", true, true},
+		{"empty", "", false, false},
+		{"version ff", "ff-" + traceID + "-" + spanID + "-01", false, false},
+		{"version 00 with more fields", "00-" + traceID + "-" + spanID + "-01-extra", false, false},
+		{"uppercase", "00-4BF92F3577B34DA6A3CE929D0E0E4736-" + spanID + "-01", false, false},
+		{"zero trace id", "00-00000000000000000000000000000000-" + spanID + "-01", false, false},
+		{"zero span id", "00-" + traceID + "-0000000000000000-01", false, false},
+		{"short trace id", "00-4bf92f3577b34da6-" + spanID + "-01", false, false},
+		{"not hex", "00-" + traceID + "-00f067aa0ba902bx-01", false, false},
+		{"bad flags", "00-" + traceID + "-" + spanID + "-1", false, false},
+		{"missing fields", "00-" + traceID + "-" + spanID, false, false},
+	}
+
+	for _, test := range tests {
+		ctx := Extract(context.Background(), test.traceparent)
+		span, ok := ctx.Value(spanKey{}).(*Span)
+		if ok != test.valid {
+			t.Errorf("%s: got a span %t, want %t", test.name, ok, test.valid)
+			continue
+		}
+		if ok && span.sampled != test.sampled {
+			t.Errorf("%s: got sampled %t, want %t", test.name, span.sampled, test.sampled)
+		}
+		if FromContext(ctx) != nil {
+			t.Errorf("%s: got the remote span from FromContext", test.name)
+		}
+	}
+}
+
+func TestInjectExtract(t *testing.T) {
+	_, cleanup := setup(nil)
+	defer cleanup()
+
+	if headers := Inject(context.Background(), nil); headers != nil {
+		t.Errorf("no span: got headers %v, want nil", headers)
+	}
+
+	traceparent := "00-" + traceID + "-" + spanID + "-01"
+	ctx, span := Start(Extract(context.Background(), traceparent), "child", KindServer)
+	headers := Inject(ctx, map[string]string{"x": "y"})
+	got := headers[TraceparentHeader]
+	want := "00-" + traceID + "-" + hex.EncodeToString(span.spanID[:]) + "-01"
+	if got != want || headers["x"] != "y" {
+		t.Fatalf("got headers %v, want traceparent %s", headers, want)
+	}
+
+	// the injected header continues the same trace with the child as parent
+	remote := Extract(context.Background(), got).Value(spanKey{}).(*Span)
+	if remote.traceID != span.traceID || remote.spanID != span.spanID || !remote.sampled {
+		t.Errorf("round trip: got %s, want %s", Traceparent(Extract(context.Background(), got)), got)
+	}
+
+	unsampled := "00-" + traceID + "-" + spanID + "-00"
+	ctx, _ = Start(Extract(context.Background(), unsampled), "child", KindServer)
+	if got := Traceparent(ctx); got[len(got)-2:] != "00" {
+		t.Errorf("unsampled parent: got %s, want flags 00", got)
+	}
+}
+
+func TestExport(t *testing.T) {
+	c, cleanup := setup(map[string]secret.Secret{"Authorization": "Bearer token"})
+
+	traceparent := "00-" + traceID + "-" + spanID + "-01"
+	ctx, parent := Start(Extract(context.Background(), traceparent), "tip getAbsences", KindServer)
+	parent.SetAttribute("tip.path", "getAbsences")
+	parent.SetAttribute("http.status_code", 200)
+	parent.SetAttribute("ratio", 0.5)
+	parent.SetAttribute("retried", false)
+	_, child := Start(ctx, "flyvo GET", KindClient)
+	child.SetError(errors.New("flyvo is down"))
+	child.End()
+	parent.End()
+	parent.End()
+	cleanup()
+
+	request := <-c.requests
+	if header := (<-c.headers).Get("Authorization"); header != "Bearer token" {
+		t.Errorf("got Authorization %q, want the configured header", header)
+	}
+	if len(request.ResourceSpans) != 1 || len(request.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("got %+v, want one resource and scope", request)
+	}
+	resource := request.ResourceSpans[0].Resource.Attributes
+	if len(resource) != 2 || resource[0].Key != "service.name" || *resource[0].Value.String != defaultServiceName {
+		t.Errorf("got resource attributes %+v, want service.name %s", resource, defaultServiceName)
+	}
+
+	spans := request.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2 with the parent ended once", len(spans))
+	}
+	exportedChild, exportedParent := spans[0], spans[1]
+	if exportedParent.TraceID != traceID || exportedParent.ParentSpanID != spanID ||
+		exportedParent.Kind != KindServer || exportedParent.Status != nil {
+		t.Errorf("got parent %+v, want a server span in the remote trace", exportedParent)
+	}
+	if exportedChild.TraceID != traceID || exportedChild.ParentSpanID != exportedParent.SpanID ||
+		exportedChild.Kind != KindClient {
+		t.Errorf("got child %+v, want a client span under the parent", exportedChild)
+	}
+	if exportedChild.Status == nil || exportedChild.Status.Code != 2 ||
+		exportedChild.Status.Message != "flyvo is down" {
+		t.Errorf("got child status %+v, want error", exportedChild.Status)
+	}
+	if exportedParent.Start == "" || exportedParent.End < exportedParent.Start {
+		t.Errorf("got times %s-%s", exportedParent.Start, exportedParent.End)
+	}
+
+	attrs := exportedParent.Attributes
+	keys := []string{}
+	for _, attr := range attrs {
+		keys = append(keys, attr.Key)
+	}
+	want := []string{"http.status_code", "ratio", "retried", "tip.path"}
+	if len(keys) != len(want) {
+		t.Fatalf("got attributes %v, want %v", keys, want)
+	}
+	for i := range want {
+		if keys[i] != want[i] {
+			t.Fatalf("got attributes %v, want %v", keys, want)
+		}
+	}
+	if *attrs[0].Value.Int != "200" || *attrs[1].Value.Double != 0.5 || *attrs[2].Value.Bool ||
+		*attrs[3].Value.String != "getAbsences" {
+		t.Errorf("got attribute values %+v", attrs)
+	}
+}
+
+func TestSampling(t *testing.T) {
+	c, cleanup := setup(nil)
+	exporterLock.Lock()
+	none := 0.0
+	exporter.cfg.SampleRatio = &none
+	exporterLock.Unlock()
+
+	_, span := Start(context.Background(), "dropped", KindInternal)
+	span.End()
+	sampled := "00-" + traceID + "-" + spanID + "-01"
+	_, span = Start(Extract(context.Background(), sampled), "kept", KindServer)
+	span.End()
+	cleanup()
+
+	spans := (<-c.requests).ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 1 || spans[0].Name != "kept" {
+		t.Errorf("got %+v, want only the span whose caller sampled it", spans)
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	ctx, span := Start(context.Background(), "off", KindInternal)
+	if span != nil || ctx != context.Background() {
+		t.Error("tracing off: got a span")
+	}
+	span.SetAttribute("a", 1)
+	span.SetError(errors.New("x"))
+	span.End()
+}
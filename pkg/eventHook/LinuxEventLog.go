@@ -1,3 +1,298 @@
 // +build linux
 
 package eventHook
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultTag      = "flyvo-rpc-client"
+	journalSocket   = "/run/systemd/journal/socket"
+	syslogSockets   = "/dev/log,/var/run/syslog,/var/run/log"
+	facilityDaemon  = 3
+	rfc5424Time     = "2006-01-02T15:04:05.000000Z07:00"
+	syslogNilValue  = "-"
+	severityUnknown = -1
+)
+
+var facilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// severity maps logrus levels to syslog severities, as EventLogHook maps them
+// to event log types. Trace is not forwarded.
+func severity(level logrus.Level) int {
+	switch level {
+	case logrus.PanicLevel, logrus.FatalLevel:
+		return 2 // crit
+	case logrus.ErrorLevel:
+		return 3 // err
+	case logrus.WarnLevel:
+		return 4 // warning
+	case logrus.InfoLevel:
+		return 6 // info
+	case logrus.DebugLevel:
+		return 7 // debug
+	default:
+		return severityUnknown
+	}
+}
+
+// format returns the entry as the console would show it, without colours
+func format(entry *logrus.Entry) ([]byte, error) {
+	if _, ok := entry.Logger.Formatter.(*logrus.JSONFormatter); ok {
+		return entry.Logger.Formatter.Format(entry)
+	}
+	return (&logrus.TextFormatter{DisableColors: true, DisableTimestamp: true}).Format(entry)
+}
+
+// SyslogHook sends log entries to a syslog server as RFC 5424 messages
+type SyslogHook struct {
+	network  string
+	address  string
+	tag      string
+	facility int
+	hostname string
+
+	lock sync.Mutex
+	conn net.Conn
+}
+
+// NewSyslogHook creates a syslog hook, and connects to the syslog server
+func NewSyslogHook(cfg Syslog) (*SyslogHook, error) {
+	hook := &SyslogHook{
+		network:  cfg.Network,
+		address:  cfg.Address,
+		tag:      cfg.Tag,
+		facility: facilityDaemon,
+	}
+	if hook.tag == "" {
+		hook.tag = defaultTag
+	}
+	if cfg.Facility != "" {
+		facility, ok := facilities[strings.ToLower(cfg.Facility)]
+		if !ok {
+			return nil, fmt.Errorf("unknown syslog facility '%s'", cfg.Facility)
+		}
+		hook.facility = facility
+	}
+	switch hook.network {
+	case "", "unix", "unixgram":
+		hook.network = "unix"
+	case "udp", "tcp":
+		if hook.address == "" {
+			return nil, fmt.Errorf("no syslog address set for %s", hook.network)
+		}
+	default:
+		return nil, fmt.Errorf("unknown syslog network '%s'", cfg.Network)
+	}
+
+	hook.hostname, _ = os.Hostname()
+	if hook.hostname == "" {
+		hook.hostname = syslogNilValue
+	}
+
+	hook.lock.Lock()
+	defer hook.lock.Unlock()
+	return hook, hook.connect()
+}
+
+func (hook *SyslogHook) connect() error {
+	if hook.conn != nil {
+		hook.conn.Close()
+		hook.conn = nil
+	}
+
+	if hook.network != "unix" {
+		conn, err := net.DialTimeout(hook.network, hook.address, 5*time.Second)
+		if err != nil {
+			return err
+		}
+		hook.conn = conn
+		return nil
+	}
+
+	addresses := strings.Split(syslogSockets, ",")
+	if hook.address != "" {
+		addresses = []string{hook.address}
+	}
+	var err error
+	for _, address := range addresses {
+		for _, network := range []string{"unixgram", "unix"} {
+			var conn net.Conn
+			conn, err = net.Dial(network, address)
+			if err == nil {
+				hook.conn = conn
+				return nil
+			}
+		}
+	}
+	return err
+}
+
+func (hook *SyslogHook) Fire(entry *logrus.Entry) error {
+	sev := severity(entry.Level)
+	if sev == severityUnknown {
+		return nil
+	}
+	line, err := format(entry)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to read entry, %v", err)
+		return err
+	}
+
+	// <PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+	msg := fmt.Sprintf("<%d>1 %s %s %s %d %s %s %s",
+		hook.facility*8+sev,
+		entry.Time.Format(rfc5424Time),
+		hook.hostname,
+		hook.tag,
+		os.Getpid(),
+		syslogNilValue,
+		syslogNilValue,
+		bytes.TrimRight(line, "\n"),
+	)
+	// Stream transports need octet counting to tell messages apart (RFC 6587)
+	if hook.network == "tcp" {
+		msg = strconv.Itoa(len(msg)) + " " + msg
+	}
+
+	hook.lock.Lock()
+	defer hook.lock.Unlock()
+	if hook.conn == nil {
+		err = hook.connect()
+		if err != nil {
+			return err
+		}
+	}
+	_, err = hook.conn.Write([]byte(msg))
+	if err != nil {
+		// The server may have restarted, so reconnect once
+		err = hook.connect()
+		if err == nil {
+			_, err = hook.conn.Write([]byte(msg))
+		}
+	}
+	return err
+}
+
+func (hook *SyslogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// JournaldHook sends log entries to the systemd journal through its native
+// protocol, with the entry fields as journal fields
+type JournaldHook struct {
+	tag  string
+	conn *net.UnixConn
+}
+
+// NewJournaldHook connects to the local systemd journal
+func NewJournaldHook(tag string) (*JournaldHook, error) {
+	if tag == "" {
+		tag = defaultTag
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &JournaldHook{tag: tag, conn: conn}, nil
+}
+
+func (hook *JournaldHook) Fire(entry *logrus.Entry) error {
+	sev := severity(entry.Level)
+	if sev == severityUnknown {
+		return nil
+	}
+
+	var msg bytes.Buffer
+	journalField(&msg, "MESSAGE", entry.Message)
+	journalField(&msg, "PRIORITY", strconv.Itoa(sev))
+	journalField(&msg, "SYSLOG_IDENTIFIER", hook.tag)
+	for key, value := range entry.Data {
+		journalField(&msg, journalKey(key), fmt.Sprint(value))
+	}
+
+	_, err := hook.conn.Write(msg.Bytes())
+	if err == nil {
+		return nil
+	}
+
+	// Too large for a datagram, so pass it in a file descriptor instead
+	if errors.Is(err, syscall.EMSGSIZE) || errors.Is(err, syscall.ENOBUFS) {
+		return hook.sendFile(msg.Bytes())
+	}
+	return err
+}
+
+func (hook *JournaldHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (hook *JournaldHook) sendFile(msg []byte) error {
+	file, err := ioutil.TempFile("/dev/shm", "journal.")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	os.Remove(file.Name())
+
+	_, err = file.Write(msg)
+	if err != nil {
+		return err
+	}
+	_, _, err = hook.conn.WriteMsgUnix([]byte{}, syscall.UnixRights(int(file.Fd())), nil)
+	return err
+}
+
+// journalField appends a field in the journal export format. Values with
+// newlines are written with an explicit length.
+func journalField(msg *bytes.Buffer, key, value string) {
+	if !strings.ContainsRune(value, '\n') {
+		msg.WriteString(key + "=" + value + "\n")
+		return
+	}
+	msg.WriteString(key + "\n")
+	binary.Write(msg, binary.LittleEndian, uint64(len(value)))
+	msg.WriteString(value + "\n")
+}
+
+// journalKey turns a log field name into a journal field name, which may only
+// hold upper case letters, digits and underscores, and not start with one
+func journalKey(key string) string {
+	name := strings.Map(func(r rune) rune {
+		if r > unicode.MaxASCII {
+			return '_'
+		}
+		if unicode.IsLetter(r) {
+			return unicode.ToUpper(r)
+		}
+		if unicode.IsDigit(r) {
+			return r
+		}
+		return '_'
+	}, key)
+	name = strings.TrimLeft(name, "_0123456789")
+	if name == "" {
+		name = "FIELD"
+	}
+	return name
+}
@@ -0,0 +1,15 @@
+package eventHook
+
+// Syslog - where the syslog hook sends entries (Linux only). Network is udp,
+// tcp or unix, with unix and the local syslog socket used if both are empty.
+type Syslog struct {
+	Network  string `yaml:"network"`
+	Address  string `yaml:"address"`
+	Tag      string `yaml:"tag"`
+	Facility string `yaml:"facility"`
+}
+
+// Enabled returns true if the syslog hook is configured
+func (s Syslog) Enabled() bool {
+	return s.Network != "" || s.Address != ""
+}
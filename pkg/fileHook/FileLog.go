@@ -1,34 +1,252 @@
-// +build windows
-
 package filehook
 
 import (
+	"compress/gzip"
 	"fmt"
-	"github.com/sirupsen/logrus"
+	"io"
 	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultMaxSize    = 100
+	defaultMaxBackups = 10
+	reopenInterval    = time.Minute
+	rotatedTimeFormat = "20060102T150405.000"
 )
 
-// FileHook to send logs via windows log.
+// Rotation - when the log file is rotated, and how many rotated files are kept
+type Rotation struct {
+	// MaxSize in megabytes before the file is rotated (default 100)
+	MaxSize int `yaml:"maxSize"`
+	// MaxAge the file is written to before it is rotated (default never)
+	MaxAge time.Duration `yaml:"maxAge"`
+	// MaxBackups is the number of rotated files kept (default 10)
+	MaxBackups int  `yaml:"maxBackups"`
+	Compress   bool `yaml:"compress"`
+}
+
+// FileHook writes log entries to a file, rotating it as configured. If the file
+// can't be written, entries go to stderr until it can be opened again.
 type FileHook struct {
-	path string
-	file *os.File
+	path     string
+	rotation Rotation
+	text     logrus.Formatter
+
+	lock     sync.Mutex
+	file     *os.File
+	size     int64
+	opened   time.Time
+	failedAt time.Time
+
+	cleanup sync.Mutex
 }
 
-// NewHook creates and returns a new FileHook wrapped around anything that implements the debug.Log interface
-func NewHook(path string) *FileHook {
-	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-	if err != nil {
-		panic(err)
+// NewHook creates and returns a new FileHook writing to path
+func NewHook(path string, rotation Rotation) *FileHook {
+	if rotation.MaxSize <= 0 {
+		rotation.MaxSize = defaultMaxSize
+	}
+	if rotation.MaxBackups <= 0 {
+		rotation.MaxBackups = defaultMaxBackups
 	}
 
-	hook := FileHook{path: path, file: file}
-	return &hook
+	hook := &FileHook{
+		path:     path,
+		rotation: rotation,
+		text:     &logrus.TextFormatter{DisableColors: true, FullTimestamp: true},
+	}
+	hook.lock.Lock()
+	hook.open()
+	hook.lock.Unlock()
+	return hook
 }
+
 func (hook *FileHook) Fire(entry *logrus.Entry) error {
-	_, err := hook.file.WriteString(fmt.Sprintf("[%s] %v: %s\r\n", entry.Level.String(), entry.Time.String(), entry.Message))
-	return err
+	// JSON is written as is, text without the terminal colours of the console
+	formatter := hook.text
+	if _, ok := entry.Logger.Formatter.(*logrus.JSONFormatter); ok {
+		formatter = entry.Logger.Formatter
+	}
+	line, err := formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+	if runtime.GOOS == "windows" {
+		line = append(line[:len(line)-1], '\r', '\n')
+	}
+
+	hook.lock.Lock()
+	defer hook.lock.Unlock()
+
+	if hook.file == nil && time.Since(hook.failedAt) > reopenInterval {
+		hook.open()
+	}
+	if hook.file != nil && hook.due(len(line)) {
+		hook.rotate()
+	}
+	if hook.file == nil {
+		// Already on stderr if that is where the logger writes
+		if entry.Logger.Out != os.Stderr {
+			os.Stderr.Write(line)
+		}
+		return nil
+	}
+
+	n, err := hook.file.Write(line)
+	hook.size += int64(n)
+	if err != nil {
+		hook.fail(err)
+		os.Stderr.Write(line)
+	}
+	return nil
 }
 
 func (hook *FileHook) Levels() []logrus.Level {
 	return logrus.AllLevels
 }
+
+// Close closes the log file
+func (hook *FileHook) Close() error {
+	hook.lock.Lock()
+	defer hook.lock.Unlock()
+	if hook.file == nil {
+		return nil
+	}
+	err := hook.file.Close()
+	hook.file = nil
+	return err
+}
+
+// open opens the log file for appending, falling back to stderr on failure
+func (hook *FileHook) open() {
+	file, err := os.OpenFile(hook.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		hook.fail(err)
+		return
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		hook.fail(err)
+		return
+	}
+
+	hook.file = file
+	hook.size = info.Size()
+	hook.opened = time.Now()
+}
+
+func (hook *FileHook) fail(err error) {
+	fmt.Fprintf(os.Stderr, "Unable to write log file %s, logging to stderr: %v\n", hook.path, err)
+	if hook.file != nil {
+		hook.file.Close()
+		hook.file = nil
+	}
+	hook.failedAt = time.Now()
+}
+
+// due returns true if writing n more bytes should go to a new file
+func (hook *FileHook) due(n int) bool {
+	if hook.size == 0 {
+		return false
+	}
+	if hook.size+int64(n) > int64(hook.rotation.MaxSize)*1024*1024 {
+		return true
+	}
+	return hook.rotation.MaxAge > 0 && time.Since(hook.opened) > hook.rotation.MaxAge
+}
+
+// rotate renames the current file with a timestamp and opens a new one.
+// Compression and removal of old files happen in the background.
+func (hook *FileHook) rotate() {
+	hook.file.Close()
+	hook.file = nil
+
+	ext := filepath.Ext(hook.path)
+	rotated := fmt.Sprintf("%s-%s%s",
+		strings.TrimSuffix(hook.path, ext), time.Now().Format(rotatedTimeFormat), ext)
+	err := os.Rename(hook.path, rotated)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to rotate log file %s: %v\n", hook.path, err)
+		rotated = ""
+	}
+
+	hook.open()
+	if rotated != "" {
+		go hook.clean(rotated)
+	}
+}
+
+// clean compresses a rotated file if configured, and removes the oldest
+// rotated files beyond MaxBackups
+func (hook *FileHook) clean(rotated string) {
+	hook.cleanup.Lock()
+	defer hook.cleanup.Unlock()
+
+	if hook.rotation.Compress {
+		err := compress(rotated)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to compress log file %s: %v\n", rotated, err)
+		}
+	}
+
+	ext := filepath.Ext(hook.path)
+	matches, err := filepath.Glob(strings.TrimSuffix(hook.path, ext) + "-*" + ext + "*")
+	if err != nil {
+		return
+	}
+	var backups []string
+	for _, match := range matches {
+		if strings.HasSuffix(match, ext) || strings.HasSuffix(match, ext+".gz") {
+			backups = append(backups, match)
+		}
+	}
+	if len(backups) <= hook.rotation.MaxBackups {
+		return
+	}
+
+	// Timestamps sort oldest first
+	sort.Strings(backups)
+	for _, old := range backups[:len(backups)-hook.rotation.MaxBackups] {
+		err = os.Remove(old)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to remove old log file %s: %v\n", old, err)
+		}
+	}
+}
+
+func compress(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	_, err = io.Copy(gz, in)
+	if err == nil {
+		err = gz.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+
+	in.Close()
+	return os.Remove(path)
+}
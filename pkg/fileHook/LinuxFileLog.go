@@ -1,2 +0,0 @@
-// +build linux
-package filehook
@@ -1,20 +1,199 @@
 package healthcheck
 
 import (
+	"context"
+	"encoding/json"
 	"net/http"
+	"sync"
+	"time"
 
-	log "github.com/sirupsen/logrus"
+	"github.com/tktip/flyvo-rpc-client/internal/log"
 )
 
-func health(w http.ResponseWriter, _ *http.Request) {
+const (
+	defaultCacheTTL = 10 * time.Second
+	defaultTimeout  = 3 * time.Second
+)
+
+// Config - how dependencies are probed, and where the health endpoints are
+// served besides the api. Address is for probes that can't reach the api, e.g.
+// because it requires client certificates.
+type Config struct {
+	Address  string        `yaml:"address"`
+	CacheTTL time.Duration `yaml:"cacheTTL"`
+	Timeout  time.Duration `yaml:"timeout"`
+}
+
+// Probe checks a dependency, returning nil if it is usable
+type Probe func(ctx context.Context) error
+
+// DependencyStatus - the last known state of a dependency
+type DependencyStatus struct {
+	Name        string     `json:"name"`
+	Healthy     bool       `json:"healthy"`
+	LastError   string     `json:"lastError,omitempty"`
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+	LastChecked *time.Time `json:"lastChecked,omitempty"`
+}
+
+// Status - the state of the service and its dependencies
+type Status struct {
+	Ready        bool               `json:"ready"`
+	Version      string             `json:"version"`
+	Started      time.Time          `json:"started"`
+	Dependencies []DependencyStatus `json:"dependencies"`
+}
+
+// Checker probes dependencies, caching each result for CacheTTL so frequent
+// health checks don't load them
+type Checker struct {
+	version string
+	started time.Time
+	ttl     time.Duration
+	timeout time.Duration
+	checks  []*check
+}
+
+type check struct {
+	name  string
+	probe Probe
+
+	lock        sync.Mutex
+	lastChecked time.Time
+	lastSuccess time.Time
+	lastError   error
+}
+
+// NewChecker creates a checker without dependencies
+func NewChecker(cfg Config, version string) *Checker {
+	if cfg.CacheTTL <= 0 {
+		cfg.CacheTTL = defaultCacheTTL
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultTimeout
+	}
+	return &Checker{
+		version: version,
+		started: time.Now(),
+		ttl:     cfg.CacheTTL,
+		timeout: cfg.Timeout,
+	}
+}
+
+// Add adds a dependency that must be healthy for the service to be ready
+func (c *Checker) Add(name string, probe Probe) {
+	c.checks = append(c.checks, &check{name: name, probe: probe})
+}
+
+// Status probes the dependencies whose cached results are stale, in parallel
+func (c *Checker) Status(ctx context.Context) Status {
+	status := Status{
+		Ready:        true,
+		Version:      c.version,
+		Started:      c.started,
+		Dependencies: make([]DependencyStatus, len(c.checks)),
+	}
+
+	var wg sync.WaitGroup
+	for i, chk := range c.checks {
+		wg.Add(1)
+		go func(i int, chk *check) {
+			defer wg.Done()
+			status.Dependencies[i] = chk.status(ctx, c.ttl, c.timeout)
+		}(i, chk)
+	}
+	wg.Wait()
+
+	for _, dep := range status.Dependencies {
+		status.Ready = status.Ready && dep.Healthy
+	}
+	return status
+}
+
+// status returns the cached result, probing first if it is older than ttl.
+// Concurrent callers wait for the same probe.
+func (chk *check) status(ctx context.Context, ttl, timeout time.Duration) DependencyStatus {
+	chk.lock.Lock()
+	defer chk.lock.Unlock()
+
+	if time.Since(chk.lastChecked) >= ttl {
+		probeCtx, cancel := context.WithTimeout(ctx, timeout)
+		err := chk.probe(probeCtx)
+		cancel()
+
+		chk.lastChecked = time.Now()
+		chk.lastError = err
+		if err == nil {
+			chk.lastSuccess = chk.lastChecked
+		}
+	}
+
+	status := DependencyStatus{
+		Name:    chk.name,
+		Healthy: chk.lastError == nil,
+	}
+	if chk.lastError != nil {
+		status.LastError = chk.lastError.Error()
+	}
+	if !chk.lastSuccess.IsZero() {
+		success := chk.lastSuccess
+		status.LastSuccess = &success
+	}
+	checked := chk.lastChecked
+	status.LastChecked = &checked
+	return status
+}
+
+// Healthz reports that the process is up
+func (c *Checker) Healthz(w http.ResponseWriter, _ *http.Request) {
+	w.Write([]byte("OK"))
+}
+
+// Readyz reports whether every dependency is healthy, with 503 if not
+func (c *Checker) Readyz(w http.ResponseWriter, r *http.Request) {
+	status := c.Status(r.Context())
+	if !status.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("NOT READY"))
+		return
+	}
 	w.Write([]byte("OK"))
 }
 
-// StartHealthService starts a health-check service
-func StartHealthService() {
-	http.HandleFunc("/health", health)
-	log.Printf("Staring health check on http://localhost:8090/health")
-	if err := http.ListenAndServe(":8090", nil); err != nil {
-		panic(err)
+// StatusHandler reports the state of every dependency as json, with 503 if
+// any is unhealthy
+func (c *Checker) StatusHandler(w http.ResponseWriter, r *http.Request) {
+	status := c.Status(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	if !status.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+// Handler serves /healthz, /readyz and /status
+func (c *Checker) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", c.Healthz)
+	mux.HandleFunc("/readyz", c.Readyz)
+	mux.HandleFunc("/status", c.StatusHandler)
+	return mux
+}
+
+// StartHealthService serves the health endpoints on address until ctx is done
+func StartHealthService(ctx context.Context, address string, checker *Checker) error {
+	srv := &http.Server{Addr: address, Handler: checker.Handler()}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	log.Logger.Infof("Starting health check on http://%s/healthz", address)
+	err := srv.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
 	}
+	return err
 }